@@ -41,6 +41,7 @@ import (
 	"fmt"
 	"github.com/notedit/rtmp-lib/aac"
 	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/opus"
 	"runtime"
 	"time"
 	"unsafe"
@@ -327,6 +328,11 @@ func (self *AudioEncoder) Setup() (err error) {
 			return
 		}
 
+	case C.AV_CODEC_ID_OPUS:
+		if self.codecData, err = opus.NewCodecDataFromOpusHead(extradata); err != nil {
+			return
+		}
+
 	default:
 		self.codecData = audioCodecData{
 			channelLayout: self.ChannelLayout,
@@ -684,9 +690,24 @@ func NewAudioDecoder(codec av.AudioCodecData) (dec *AudioDecoder, err error) {
 			return
 		}
 
+	case av.OPUS:
+		if opuscodec, ok := codec.(opus.CodecData); ok {
+			_dec.Extradata = opuscodec.OpusHeadBytes()
+			id = C.AV_CODEC_ID_OPUS
+		} else {
+			err = fmt.Errorf("ffmpeg: opus CodecData must be opus.CodecData")
+			return
+		}
+
 	case av.SPEEX:
 		id = C.AV_CODEC_ID_SPEEX
 
+	case av.MP3:
+		id = C.AV_CODEC_ID_MP3
+
+	case av.NELLYMOSER:
+		id = C.AV_CODEC_ID_NELLYMOSER
+
 	case av.PCM_MULAW:
 		id = C.AV_CODEC_ID_PCM_MULAW
 
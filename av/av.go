@@ -121,6 +121,11 @@ var (
 	PCM_ALAW   = MakeAudioCodecType(avCodecTypeMagic + 3)
 	SPEEX      = MakeAudioCodecType(avCodecTypeMagic + 4)
 	NELLYMOSER = MakeAudioCodecType(avCodecTypeMagic + 5)
+	H265       = MakeVideoCodecType(avCodecTypeMagic + 2)
+	AV1        = MakeVideoCodecType(avCodecTypeMagic + 3)
+	VP9        = MakeVideoCodecType(avCodecTypeMagic + 4)
+	OPUS       = MakeAudioCodecType(avCodecTypeMagic + 6)
+	MP3        = MakeAudioCodecType(avCodecTypeMagic + 7)
 )
 
 const codecTypeAudioBit = 0x1
@@ -140,6 +145,16 @@ func (self CodecType) String() string {
 		return "SPEEX"
 	case NELLYMOSER:
 		return "NELLYMOSER"
+	case OPUS:
+		return "OPUS"
+	case MP3:
+		return "MP3"
+	case H265:
+		return "H265"
+	case AV1:
+		return "AV1"
+	case VP9:
+		return "VP9"
 	}
 	return ""
 }
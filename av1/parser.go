@@ -0,0 +1,569 @@
+package av1
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/bits"
+)
+
+const (
+	OBU_SEQUENCE_HEADER        = 1
+	OBU_TEMPORAL_DELIMITER     = 2
+	OBU_FRAME_HEADER           = 3
+	OBU_TILE_GROUP             = 4
+	OBU_METADATA               = 5
+	OBU_FRAME                  = 6
+	OBU_REDUNDANT_FRAME_HEADER = 7
+	OBU_TILE_LIST              = 8
+	OBU_PADDING                = 15
+)
+
+func readLeb128(b []byte) (val uint64, n int, ok bool) {
+	for i := 0; i < 8; i++ {
+		if len(b) <= n {
+			return
+		}
+		c := b[n]
+		n++
+		val |= uint64(c&0x7f) << uint(i*7)
+		if c&0x80 == 0 {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+// SplitOBUs splits a low overhead bitstream into OBUs, each OBU keeps its
+// header. The last OBU may omit obu_size.
+func SplitOBUs(b []byte) (obus [][]byte, err error) {
+	for len(b) > 0 {
+		hdrlen := 1
+		if b[0]&0x04 != 0 {
+			hdrlen++
+		}
+		if len(b) < hdrlen {
+			err = fmt.Errorf("av1parser: obu header invalid")
+			return
+		}
+		size := uint64(len(b) - hdrlen)
+		if b[0]&0x02 != 0 {
+			var n int
+			var ok bool
+			if size, n, ok = readLeb128(b[hdrlen:]); !ok {
+				err = fmt.Errorf("av1parser: obu size invalid")
+				return
+			}
+			hdrlen += n
+		}
+		if uint64(len(b)-hdrlen) < size {
+			err = fmt.Errorf("av1parser: obu size invalid")
+			return
+		}
+		end := hdrlen + int(size)
+		obus = append(obus, b[:end])
+		b = b[end:]
+	}
+	return
+}
+
+func OBUType(obu []byte) uint8 {
+	return (obu[0] >> 3) & 0xf
+}
+
+// OBUPayload returns obu data after its header and size field.
+func OBUPayload(obu []byte) []byte {
+	hdrlen := 1
+	if obu[0]&0x04 != 0 {
+		hdrlen++
+	}
+	if obu[0]&0x02 != 0 {
+		_, n, _ := readLeb128(obu[hdrlen:])
+		hdrlen += n
+	}
+	if hdrlen > len(obu) {
+		return nil
+	}
+	return obu[hdrlen:]
+}
+
+type SequenceHeader struct {
+	SeqProfile              uint
+	StillPicture            uint
+	ReducedStillPictureHdr  uint
+	SeqLevelIdx0            uint
+	SeqTier0                uint
+	MaxFrameWidth           uint
+	MaxFrameHeight          uint
+	TimingInfoPresent       uint
+	NumUnitsInDisplayTick   uint
+	TimeScale               uint
+	EqualPictureInterval    uint
+	NumTicksPerPictureMinus uint
+	// color_config
+	HighBitdepth            uint
+	TwelveBit               uint
+	MonoChrome              uint
+	ColorPrimaries          uint
+	TransferCharacteristics uint
+	MatrixCoefficients      uint
+	ColorRange              uint
+	ChromaSubsamplingX      uint
+	ChromaSubsamplingY      uint
+	ChromaSamplePosition    uint
+}
+
+// BitDepth returns 8, 10 or 12.
+func (self SequenceHeader) BitDepth() int {
+	switch {
+	case self.TwelveBit != 0:
+		return 12
+	case self.HighBitdepth != 0:
+		return 10
+	}
+	return 8
+}
+
+func readUvlc(r *bits.GolombBitReader) (val uint, err error) {
+	leadingZeros := 0
+	for {
+		var bit uint
+		if bit, err = r.ReadBit(); err != nil {
+			return
+		}
+		if bit != 0 {
+			break
+		}
+		leadingZeros++
+	}
+	if leadingZeros >= 32 {
+		val = (1 << 32) - 1
+		return
+	}
+	if val, err = r.ReadBits(leadingZeros); err != nil {
+		return
+	}
+	val += (1 << uint(leadingZeros)) - 1
+	return
+}
+
+// ParseSequenceHeader parses the payload of a OBU_SEQUENCE_HEADER, up to
+// the color config.
+func ParseSequenceHeader(data []byte) (self SequenceHeader, err error) {
+	r := &bits.GolombBitReader{R: bytes.NewReader(data)}
+
+	if self.SeqProfile, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if self.StillPicture, err = r.ReadBit(); err != nil {
+		return
+	}
+	if self.ReducedStillPictureHdr, err = r.ReadBit(); err != nil {
+		return
+	}
+
+	if self.ReducedStillPictureHdr != 0 {
+		if self.SeqLevelIdx0, err = r.ReadBits(5); err != nil {
+			return
+		}
+	} else {
+		if self.TimingInfoPresent, err = r.ReadBit(); err != nil {
+			return
+		}
+
+		var decoderModelInfoPresent uint
+		var bufferDelayLength uint
+		if self.TimingInfoPresent != 0 {
+			if self.NumUnitsInDisplayTick, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if self.TimeScale, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if self.EqualPictureInterval, err = r.ReadBit(); err != nil {
+				return
+			}
+			if self.EqualPictureInterval != 0 {
+				if self.NumTicksPerPictureMinus, err = readUvlc(r); err != nil {
+					return
+				}
+			}
+
+			if decoderModelInfoPresent, err = r.ReadBit(); err != nil {
+				return
+			}
+			if decoderModelInfoPresent != 0 {
+				// buffer_delay_length_minus_1
+				if bufferDelayLength, err = r.ReadBits(5); err != nil {
+					return
+				}
+				bufferDelayLength++
+				// num_units_in_decoding_tick
+				if _, err = r.ReadBits(32); err != nil {
+					return
+				}
+				// buffer_removal_time_length_minus_1, frame_presentation_time_length_minus_1
+				if _, err = r.ReadBits(10); err != nil {
+					return
+				}
+			}
+		}
+
+		var initialDisplayDelayPresent uint
+		if initialDisplayDelayPresent, err = r.ReadBit(); err != nil {
+			return
+		}
+
+		var operatingPointsCnt uint
+		if operatingPointsCnt, err = r.ReadBits(5); err != nil {
+			return
+		}
+		operatingPointsCnt++
+
+		for i := uint(0); i < operatingPointsCnt; i++ {
+			// operating_point_idc
+			if _, err = r.ReadBits(12); err != nil {
+				return
+			}
+			var seqLevelIdx, seqTier uint
+			if seqLevelIdx, err = r.ReadBits(5); err != nil {
+				return
+			}
+			if seqLevelIdx > 7 {
+				if seqTier, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+			if i == 0 {
+				self.SeqLevelIdx0 = seqLevelIdx
+				self.SeqTier0 = seqTier
+			}
+			if decoderModelInfoPresent != 0 {
+				var decoderModelPresent uint
+				if decoderModelPresent, err = r.ReadBit(); err != nil {
+					return
+				}
+				if decoderModelPresent != 0 {
+					// decoder_buffer_delay, encoder_buffer_delay, low_delay_mode_flag
+					if _, err = r.ReadBits(int(bufferDelayLength)*2 + 1); err != nil {
+						return
+					}
+				}
+			}
+			if initialDisplayDelayPresent != 0 {
+				var present uint
+				if present, err = r.ReadBit(); err != nil {
+					return
+				}
+				if present != 0 {
+					// initial_display_delay_minus_1
+					if _, err = r.ReadBits(4); err != nil {
+						return
+					}
+				}
+			}
+		}
+	}
+
+	var widthBits, heightBits uint
+	if widthBits, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if heightBits, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if self.MaxFrameWidth, err = r.ReadBits(int(widthBits) + 1); err != nil {
+		return
+	}
+	self.MaxFrameWidth++
+	if self.MaxFrameHeight, err = r.ReadBits(int(heightBits) + 1); err != nil {
+		return
+	}
+	self.MaxFrameHeight++
+
+	var frameIdNumbersPresent uint
+	if self.ReducedStillPictureHdr == 0 {
+		if frameIdNumbersPresent, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if frameIdNumbersPresent != 0 {
+		// delta_frame_id_length_minus_2, additional_frame_id_length_minus_1
+		if _, err = r.ReadBits(7); err != nil {
+			return
+		}
+	}
+
+	// use_128x128_superblock, enable_filter_intra, enable_intra_edge_filter
+	if _, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if self.ReducedStillPictureHdr == 0 {
+		// enable_interintra_compound, enable_masked_compound,
+		// enable_warped_motion, enable_dual_filter
+		if _, err = r.ReadBits(4); err != nil {
+			return
+		}
+		var enableOrderHint uint
+		if enableOrderHint, err = r.ReadBit(); err != nil {
+			return
+		}
+		if enableOrderHint != 0 {
+			// enable_jnt_comp, enable_ref_frame_mvs
+			if _, err = r.ReadBits(2); err != nil {
+				return
+			}
+		}
+		var chooseScreenContentTools uint
+		if chooseScreenContentTools, err = r.ReadBit(); err != nil {
+			return
+		}
+		forceScreenContentTools := uint(2) // SELECT_SCREEN_CONTENT_TOOLS
+		if chooseScreenContentTools == 0 {
+			if forceScreenContentTools, err = r.ReadBit(); err != nil {
+				return
+			}
+		}
+		if forceScreenContentTools > 0 {
+			var chooseIntegerMv uint
+			if chooseIntegerMv, err = r.ReadBit(); err != nil {
+				return
+			}
+			if chooseIntegerMv == 0 {
+				// seq_force_integer_mv
+				if _, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+		}
+		if enableOrderHint != 0 {
+			// order_hint_bits_minus_1
+			if _, err = r.ReadBits(3); err != nil {
+				return
+			}
+		}
+	}
+	// enable_superres, enable_cdef, enable_restoration
+	if _, err = r.ReadBits(3); err != nil {
+		return
+	}
+
+	err = self.parseColorConfig(r)
+	return
+}
+
+func (self *SequenceHeader) parseColorConfig(r *bits.GolombBitReader) (err error) {
+	if self.HighBitdepth, err = r.ReadBit(); err != nil {
+		return
+	}
+	if self.SeqProfile == 2 && self.HighBitdepth != 0 {
+		if self.TwelveBit, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if self.SeqProfile != 1 {
+		if self.MonoChrome, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	var colorDescriptionPresent uint
+	if colorDescriptionPresent, err = r.ReadBit(); err != nil {
+		return
+	}
+	if colorDescriptionPresent != 0 {
+		if self.ColorPrimaries, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if self.TransferCharacteristics, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if self.MatrixCoefficients, err = r.ReadBits(8); err != nil {
+			return
+		}
+	} else {
+		// CP_UNSPECIFIED, TC_UNSPECIFIED, MC_UNSPECIFIED
+		self.ColorPrimaries = 2
+		self.TransferCharacteristics = 2
+		self.MatrixCoefficients = 2
+	}
+
+	if self.MonoChrome != 0 {
+		if self.ColorRange, err = r.ReadBit(); err != nil {
+			return
+		}
+		self.ChromaSubsamplingX = 1
+		self.ChromaSubsamplingY = 1
+		return
+	}
+
+	// CP_BT_709, TC_SRGB, MC_IDENTITY
+	if self.ColorPrimaries == 1 && self.TransferCharacteristics == 13 && self.MatrixCoefficients == 0 {
+		self.ColorRange = 1
+		return
+	}
+
+	if self.ColorRange, err = r.ReadBit(); err != nil {
+		return
+	}
+	switch self.SeqProfile {
+	case 0:
+		self.ChromaSubsamplingX = 1
+		self.ChromaSubsamplingY = 1
+	case 1:
+	default:
+		if self.TwelveBit != 0 {
+			if self.ChromaSubsamplingX, err = r.ReadBit(); err != nil {
+				return
+			}
+			if self.ChromaSubsamplingX != 0 {
+				if self.ChromaSubsamplingY, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+		} else {
+			self.ChromaSubsamplingX = 1
+		}
+	}
+	if self.ChromaSubsamplingX != 0 && self.ChromaSubsamplingY != 0 {
+		if self.ChromaSamplePosition, err = r.ReadBits(2); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// AV1CodecConfRecord is the av1C box payload, carried in the enhanced
+// rtmp sequence start.
+type AV1CodecConfRecord struct {
+	SeqProfile                       uint8
+	SeqLevelIdx0                     uint8
+	SeqTier0                         uint8
+	HighBitdepth                     uint8
+	TwelveBit                        uint8
+	Monochrome                       uint8
+	ChromaSubsamplingX               uint8
+	ChromaSubsamplingY               uint8
+	ChromaSamplePosition             uint8
+	InitialPresentationDelayPresent  uint8
+	InitialPresentationDelayMinusOne uint8
+	ConfigOBUs                       []byte
+}
+
+var ErrDecconfInvalid = fmt.Errorf("av1parser: AV1CodecConfRecord invalid")
+
+func (self *AV1CodecConfRecord) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 4 {
+		err = ErrDecconfInvalid
+		return
+	}
+	// marker, version
+	if b[0] != 0x81 {
+		err = ErrDecconfInvalid
+		return
+	}
+	self.SeqProfile = b[1] >> 5
+	self.SeqLevelIdx0 = b[1] & 0x1f
+	self.SeqTier0 = b[2] >> 7
+	self.HighBitdepth = (b[2] >> 6) & 0x1
+	self.TwelveBit = (b[2] >> 5) & 0x1
+	self.Monochrome = (b[2] >> 4) & 0x1
+	self.ChromaSubsamplingX = (b[2] >> 3) & 0x1
+	self.ChromaSubsamplingY = (b[2] >> 2) & 0x1
+	self.ChromaSamplePosition = b[2] & 0x3
+	self.InitialPresentationDelayPresent = (b[3] >> 4) & 0x1
+	self.InitialPresentationDelayMinusOne = b[3] & 0xf
+	n += 4
+	self.ConfigOBUs = b[n:]
+	n += len(self.ConfigOBUs)
+	return
+}
+
+func (self AV1CodecConfRecord) Len() int {
+	return 4 + len(self.ConfigOBUs)
+}
+
+func (self AV1CodecConfRecord) Marshal(b []byte) (n int) {
+	b[0] = 0x81
+	b[1] = self.SeqProfile<<5 | self.SeqLevelIdx0&0x1f
+	b[2] = self.SeqTier0<<7 | self.HighBitdepth<<6 | self.TwelveBit<<5 | self.Monochrome<<4 |
+		self.ChromaSubsamplingX<<3 | self.ChromaSubsamplingY<<2 | self.ChromaSamplePosition&0x3
+	b[3] = self.InitialPresentationDelayPresent<<4 | self.InitialPresentationDelayMinusOne&0xf
+	n += 4
+	copy(b[n:], self.ConfigOBUs)
+	n += len(self.ConfigOBUs)
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo AV1CodecConfRecord
+	SeqHeader  SequenceHeader
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.AV1
+}
+
+func (self CodecData) AV1CodecConfRecordBytes() []byte {
+	return self.Record
+}
+
+func (self CodecData) Width() int {
+	return int(self.SeqHeader.MaxFrameWidth)
+}
+
+func (self CodecData) Height() int {
+	return int(self.SeqHeader.MaxFrameHeight)
+}
+
+func NewCodecDataFromAV1CodecConfRecord(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+
+	var obus [][]byte
+	if obus, err = SplitOBUs(self.RecordInfo.ConfigOBUs); err != nil {
+		return
+	}
+	for _, obu := range obus {
+		if OBUType(obu) == OBU_SEQUENCE_HEADER {
+			if self.SeqHeader, err = ParseSequenceHeader(OBUPayload(obu)); err != nil {
+				err = fmt.Errorf("av1parser: parse sequence header failed(%s)", err)
+				return
+			}
+			return
+		}
+	}
+
+	err = fmt.Errorf("av1parser: no sequence header found in AV1CodecConfRecord")
+	return
+}
+
+// NewCodecDataFromSequenceHeader builds the av1C record from a sequence
+// header OBU, as found at the start of a keyframe temporal unit.
+func NewCodecDataFromSequenceHeader(obu []byte) (self CodecData, err error) {
+	if self.SeqHeader, err = ParseSequenceHeader(OBUPayload(obu)); err != nil {
+		return
+	}
+	seq := self.SeqHeader
+	info := AV1CodecConfRecord{
+		SeqProfile:           uint8(seq.SeqProfile),
+		SeqLevelIdx0:         uint8(seq.SeqLevelIdx0),
+		SeqTier0:             uint8(seq.SeqTier0),
+		HighBitdepth:         uint8(seq.HighBitdepth),
+		TwelveBit:            uint8(seq.TwelveBit),
+		Monochrome:           uint8(seq.MonoChrome),
+		ChromaSubsamplingX:   uint8(seq.ChromaSubsamplingX),
+		ChromaSubsamplingY:   uint8(seq.ChromaSubsamplingY),
+		ChromaSamplePosition: uint8(seq.ChromaSamplePosition),
+		ConfigOBUs:           obu,
+	}
+	self.Record = make([]byte, info.Len())
+	info.Marshal(self.Record)
+	self.RecordInfo = info
+	return
+}
@@ -0,0 +1,103 @@
+package av1
+
+import (
+	"bytes"
+	"testing"
+)
+
+type bitWriter struct {
+	b    []byte
+	nbit uint
+}
+
+func (self *bitWriter) writeBits(val uint64, n uint) {
+	for i := n; i > 0; i-- {
+		if self.nbit%8 == 0 {
+			self.b = append(self.b, 0)
+		}
+		if val>>(i-1)&1 != 0 {
+			self.b[len(self.b)-1] |= 0x80 >> (self.nbit % 8)
+		}
+		self.nbit++
+	}
+}
+
+// testSequenceHeader is a 1920x1080 10 bit 4:2:0 BT.2020 PQ sequence
+// header OBU of Main profile, level 4.0.
+func testSequenceHeader() []byte {
+	w := &bitWriter{}
+	// seq_profile, still_picture, reduced_still_picture_header
+	w.writeBits(0, 3)
+	w.writeBits(0, 2)
+	// timing_info_present_flag, initial_display_delay_present_flag,
+	// operating_points_cnt_minus_1, operating_point_idc
+	w.writeBits(0, 2)
+	w.writeBits(0, 5)
+	w.writeBits(0, 12)
+	// seq_level_idx, seq_tier
+	w.writeBits(8, 5)
+	w.writeBits(0, 1)
+	// frame size
+	w.writeBits(10, 4)
+	w.writeBits(10, 4)
+	w.writeBits(1919, 11)
+	w.writeBits(1079, 11)
+	// frame_id_numbers_present_flag, superblock and intra tools,
+	// inter tools, enable_order_hint, jnt_comp and ref_frame_mvs
+	w.writeBits(0, 1)
+	w.writeBits(0x7, 3)
+	w.writeBits(0xf, 4)
+	w.writeBits(1, 1)
+	w.writeBits(0x3, 2)
+	// seq_choose_screen_content_tools, seq_choose_integer_mv,
+	// order_hint_bits_minus_1, superres, cdef and restoration
+	w.writeBits(1, 1)
+	w.writeBits(1, 1)
+	w.writeBits(6, 3)
+	w.writeBits(0x3, 3)
+	// high_bitdepth, mono_chrome, color description
+	w.writeBits(1, 1)
+	w.writeBits(0, 1)
+	w.writeBits(1, 1)
+	w.writeBits(9, 8)
+	w.writeBits(16, 8)
+	w.writeBits(9, 8)
+	// color_range, chroma_sample_position, separate_uv_delta_q
+	w.writeBits(0, 1)
+	w.writeBits(1, 2)
+	w.writeBits(0, 1)
+	// film_grain_params_present, trailing bits
+	w.writeBits(0, 1)
+	w.writeBits(1, 1)
+
+	return append([]byte{OBU_SEQUENCE_HEADER<<3 | 0x02, byte(len(w.b))}, w.b...)
+}
+
+func TestNewCodecDataFromSequenceHeader(t *testing.T) {
+	obu := testSequenceHeader()
+	codec, err := NewCodecDataFromSequenceHeader(obu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := codec.SeqHeader
+	if codec.Width() != 1920 || codec.Height() != 1080 {
+		t.Errorf("size %dx%d, want 1920x1080", codec.Width(), codec.Height())
+	}
+	if seq.BitDepth() != 10 || seq.MonoChrome != 0 || seq.ColorPrimaries != 9 ||
+		seq.TransferCharacteristics != 16 || seq.MatrixCoefficients != 9 {
+		t.Errorf("color config %+v", seq)
+	}
+
+	want := append([]byte{0x81, 0x08, 0x4d, 0x00}, obu...)
+	if !bytes.Equal(codec.Record, want) {
+		t.Errorf("record % x, want % x", codec.Record, want)
+	}
+
+	codec, err = NewCodecDataFromAV1CodecConfRecord(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.SeqHeader != seq {
+		t.Errorf("sequence header %+v, want %+v", codec.SeqHeader, seq)
+	}
+}
@@ -0,0 +1,170 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newChunkConns returns a writer and a reader of chunks through buf.
+func newChunkConns(buf *bytes.Buffer) (w, r *Conn) {
+	cliconn, srvconn := net.Pipe()
+	cliconn.Close()
+	srvconn.Close()
+	w = NewConn(cliconn, 4096)
+	w.bufw = bufio.NewWriter(buf)
+	r = NewConn(srvconn, 4096)
+	r.bufr = bufio.NewReader(buf)
+	return
+}
+
+func testPayload(msgtypeid uint8, size int, seed byte) []byte {
+	b := make([]byte, size)
+	for i := range b {
+		b[i] = seed + byte(i)
+	}
+	// a valid audio or video tag header, the reader parses it
+	if msgtypeid == msgtypeidAudioMsg {
+		b[0] = 0x72
+	} else {
+		copy(b, []byte{0x27, 0x01, 0, 0, 0})
+	}
+	return b
+}
+
+func TestChunkHeaders(t *testing.T) {
+	const big = 0x1000000
+
+	msgs := []struct {
+		csid      uint32
+		timestamp int32
+		msgtypeid uint8
+		msgsid    uint32
+		size      int
+		hdrtype   uint8
+	}{
+		{6, 0, msgtypeidAudioMsg, 1, 50, 0},
+		// no type 3 right after a type 0, even with the same delta
+		{6, 0, msgtypeidAudioMsg, 1, 50, 2},
+		{6, 20, msgtypeidAudioMsg, 1, 50, 2},
+		{6, 40, msgtypeidAudioMsg, 1, 50, 3},
+		{6, 60, msgtypeidAudioMsg, 1, 300, 1},
+		{6, 80, msgtypeidAudioMsg, 1, 300, 3},
+		// an extended delta, on the continuation chunks too
+		{6, 80 + big, msgtypeidAudioMsg, 1, 300, 2},
+		{6, 80 + 2*big, msgtypeidAudioMsg, 1, 300, 3},
+		// an extended timestamp on a new chunk stream
+		{7, big, msgtypeidVideoMsg, 1, 300, 0},
+		{7, big + 40, msgtypeidVideoMsg, 1, 300, 2},
+		{7, FlvTimestampMax, msgtypeidVideoMsg, 1, 300, 0},
+		{7, FlvTimestampMax + 40, msgtypeidVideoMsg, 1, 10, 1},
+		// another stream, or time going back, restart with a type 0
+		{6, 100 + 2*big, msgtypeidAudioMsg, 3, 300, 0},
+		{6, 50, msgtypeidAudioMsg, 3, 300, 0},
+	}
+
+	for _, full := range []bool{false, true} {
+		var buf bytes.Buffer
+		w, r := newChunkConns(&buf)
+		w.fullChunkHeaders = full
+
+		var offs []int
+		for i, m := range msgs {
+			offs = append(offs, buf.Len())
+			w.wlock.Lock()
+			err := w.writeMsg(false, m.csid, m.timestamp, m.msgtypeid, m.msgsid, testPayload(m.msgtypeid, m.size, byte(i)))
+			if err == nil {
+				err = w.flushWrite()
+			}
+			w.wlock.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		wire := append([]byte(nil), buf.Bytes()...)
+
+		for i, m := range msgs {
+			hdrtype := m.hdrtype
+			if full {
+				hdrtype = 0
+			}
+			if got := wire[offs[i]] >> 6; got != hdrtype {
+				t.Errorf("full=%v message %d: header type %d, want %d", full, i, got, hdrtype)
+			}
+
+			if err := r.pollMsg(); err != nil {
+				t.Fatalf("full=%v message %d: %v", full, i, err)
+			}
+			if r.timestamp != uint32(m.timestamp) || r.msgtypeid != m.msgtypeid || r.msgsid != m.msgsid {
+				t.Errorf("full=%v message %d: got time %d type %d sid %d, want %d %d %d", full, i,
+					r.timestamp, r.msgtypeid, r.msgsid, m.timestamp, m.msgtypeid, m.msgsid)
+			}
+			if !bytes.Equal(r.msgdata, testPayload(m.msgtypeid, m.size, byte(i))) {
+				t.Errorf("full=%v message %d: payload differs", full, i)
+			}
+		}
+		if buf.Len() != 0 {
+			t.Errorf("full=%v: %d bytes left", full, buf.Len())
+		}
+	}
+}
+
+// audio and video written from two goroutines interleave chunk by chunk on
+// csid 6 and 7, each is read back whole.
+func TestChunkInterleave(t *testing.T) {
+	const count = 50
+	const big = 0x1000000
+
+	var buf bytes.Buffer
+	w, r := newChunkConns(&buf)
+
+	var wg sync.WaitGroup
+	errc := make(chan error, 2)
+	write := func(csid uint32, msgtypeid uint8, base int32) {
+		defer wg.Done()
+		for i := 0; i < count; i++ {
+			payload := testPayload(msgtypeid, 1000+i, byte(i))
+			if err := w.writeMsg(true, csid, base+int32(i)*40, msgtypeid, 1, payload); err != nil {
+				errc <- err
+				return
+			}
+		}
+	}
+	wg.Add(2)
+	go write(6, msgtypeidAudioMsg, 0)
+	go write(7, msgtypeidVideoMsg, big)
+	wg.Wait()
+	close(errc)
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if err := w.flushWrite(); err != nil {
+		t.Fatal(err)
+	}
+
+	next := map[uint8]int{}
+	for n := 0; n < 2*count; n++ {
+		if err := r.pollMsg(); err != nil {
+			t.Fatalf("message %d: %v", n, err)
+		}
+		i := next[r.msgtypeid]
+		next[r.msgtypeid]++
+		base := uint32(0)
+		if r.msgtypeid == msgtypeidVideoMsg {
+			base = big
+		}
+		name := fmt.Sprintf("type %d message %d", r.msgtypeid, i)
+		if r.timestamp != base+uint32(i)*40 {
+			t.Errorf("%s: time %d, want %d", name, r.timestamp, base+uint32(i)*40)
+		}
+		if !bytes.Equal(r.msgdata, testPayload(r.msgtypeid, 1000+i, byte(i))) {
+			t.Errorf("%s: payload differs", name)
+		}
+	}
+	if next[msgtypeidAudioMsg] != count || next[msgtypeidVideoMsg] != count {
+		t.Errorf("got %v messages", next)
+	}
+}
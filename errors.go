@@ -0,0 +1,117 @@
+package rtmp
+
+import (
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/flv"
+)
+
+// status codes of onStatus and of the _result or _error of connect
+const (
+	CodeConnectSuccess  = "NetConnection.Connect.Success"
+	CodeConnectRejected = "NetConnection.Connect.Rejected"
+	CodeConnectFailed   = "NetConnection.Connect.Failed"
+	CodeCallFailed      = "NetConnection.Call.Failed"
+
+	CodePublishStart       = "NetStream.Publish.Start"
+	CodePublishBadName     = "NetStream.Publish.BadName"
+	CodeUnpublishSuccess   = "NetStream.Unpublish.Success"
+	CodePlayStart          = "NetStream.Play.Start"
+	CodePlayReset          = "NetStream.Play.Reset"
+	CodePlayFailed         = "NetStream.Play.Failed"
+	CodePlayStreamNotFound = "NetStream.Play.StreamNotFound"
+)
+
+// ProtocolError is returned when the peer breaks the rtmp protocol, the
+// connection can't go on after it.
+type ProtocolError struct {
+	Msg string
+	// Err is the error of the AMF or FLV parser, if any.
+	Err error
+}
+
+func protocolError(format string, args ...interface{}) error {
+	return &ProtocolError{Msg: fmt.Sprintf(format, args...)}
+}
+
+func (self *ProtocolError) Error() string {
+	if self.Err != nil {
+		return "rtmp: " + self.Msg + ": " + self.Err.Error()
+	}
+	return "rtmp: " + self.Msg
+}
+
+func (self *ProtocolError) Unwrap() error {
+	return self.Err
+}
+
+// HandshakeError is returned when the handshake fails, Err is the i/o
+// error that stopped it, if any. A handshake that times out returns a
+// TimeoutError instead.
+type HandshakeError struct {
+	Msg string
+	Err error
+}
+
+func handshakeError(format string, args ...interface{}) error {
+	return &HandshakeError{Msg: fmt.Sprintf(format, args...)}
+}
+
+func (self *HandshakeError) Error() string {
+	if self.Err != nil {
+		return "rtmp: handshake " + self.Msg + ": " + self.Err.Error()
+	}
+	return "rtmp: handshake " + self.Msg
+}
+
+func (self *HandshakeError) Unwrap() error {
+	return self.Err
+}
+
+// StatusError is an error status from the peer: the _error reply of a
+// command, or an onStatus of level error on a stream. Is matches the
+// StatusErrors of the same Code, so
+//
+//	errors.Is(err, &rtmp.StatusError{Code: rtmp.CodePublishBadName})
+//
+// tells a refused stream name apart.
+//
+// A server sends a StatusError returned by OnPlayOrPublish as is, other
+// errors are sent as NetStream.Publish.BadName.
+type StatusError struct {
+	// Command is the command that failed: connect, createStream, publish,
+	// play or the name given to Call.
+	Command     string
+	Level       string
+	Code        string
+	Description string
+	// Info is the whole status object, nil when the peer sent none.
+	Info flv.AMFMap
+}
+
+// newStatusError reads the status object of the first of params.
+func newStatusError(command string, params []interface{}) *StatusError {
+	status := &StatusError{Command: command}
+	if len(params) > 0 {
+		if info, ok := params[0].(flv.AMFMap); ok {
+			status.Info = info
+			status.Level, _ = info["level"].(string)
+			status.Code, _ = info["code"].(string)
+			status.Description, _ = info["description"].(string)
+		}
+	}
+	return status
+}
+
+func (self *StatusError) Error() string {
+	s := fmt.Sprintf("rtmp: %s failed: %s", self.Command, self.Code)
+	if self.Description != "" {
+		s += ": " + self.Description
+	}
+	return s
+}
+
+func (self *StatusError) Is(target error) bool {
+	status, ok := target.(*StatusError)
+	return ok && status.Code == self.Code
+}
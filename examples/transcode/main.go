@@ -5,7 +5,9 @@ import (
 	_ "github.com/notedit/rtmp-lib/aac"
 	"github.com/notedit/rtmp-lib/audio"
 	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/flv"
 	"os"
+	"time"
 
 	rtmp "github.com/notedit/rtmp-lib"
 )
@@ -19,10 +21,12 @@ func main() {
 
 	server.HandlePublish = func(conn *rtmp.Conn) {
 
-		file, err := os.Create("test.opus")
+		file, err := os.Create("test.flv")
 		if err != nil {
 			panic(err)
 		}
+		defer file.Close()
+		muxer := flv.NewMuxer(file)
 
 		streams,err := conn.Streams()
 
@@ -56,6 +60,19 @@ func main() {
 			}
 		}
 
+		aencodec, err := enc.CodecData()
+		if err != nil {
+			fmt.Println(err)
+			return
+		}
+		if err = muxer.WriteHeader([]av.CodecData{aencodec}); err != nil {
+			fmt.Println(err)
+			return
+		}
+		defer muxer.WriteTrailer()
+
+		var enctime time.Duration
+
 		for {
 			packet, err := conn.ReadPacket()
 			if err != nil {
@@ -93,7 +110,10 @@ func main() {
 				//adtsbuffer = append(adtsbuffer, adtsheader...)
 				//adtsbuffer = append(adtsbuffer, outpkt...)
 				dur,_ := enc.PacketDuration(outpkt)
-				file.Write(outpkt)
+				if err = muxer.WritePacket(av.Packet{Data: outpkt, Time: enctime}); err != nil {
+					fmt.Println(err)
+				}
+				enctime += dur
 				fmt.Println("encode dur", dur)
 				//
 				//dur, _:= aencodec.PacketDuration(outpkt)
@@ -163,6 +163,11 @@ func LenAMF0Val(_val interface{}) (n int) {
 
 	case nil:
 		n++
+
+	default:
+		if isAMF3Only(val) {
+			n += 1 + LenAMF3Val(val)
+		}
 	}
 
 	return
@@ -274,6 +279,13 @@ func FillAMF0Val(b []byte, _val interface{}) (n int) {
 	case nil:
 		b[n] = nullmarker
 		n++
+
+	default:
+		if isAMF3Only(val) {
+			b[n] = avmplusobjectmarker
+			n++
+			n += FillAMF3Val(b[n:], val)
+		}
 	}
 
 	return
@@ -458,6 +470,14 @@ func parseAMF0Val(b []byte, offset int) (val interface{}, n int, err error) {
 		val = string(b[n : n+length])
 		n += length
 
+	case avmplusobjectmarker:
+		var nval int
+		if val, nval, err = ParseAMF3Val(b[n:]); err != nil {
+			err = amf0ParseErr("avmplus", offset+n, err)
+			return
+		}
+		n += nval
+
 	default:
 		err = amf0ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, err)
 		return
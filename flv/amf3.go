@@ -0,0 +1,867 @@
+package flv
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/notedit/rtmp-lib/pio"
+)
+
+// AMF3 values are decoded into the same go types as AMF0 where possible:
+//
+//     undefined, null      nil
+//     false, true          bool
+//     integer, double      float64
+//     string, xml, xmldoc  string
+//     date                 time.Time
+//     array                AMFArray, or AMFECMAArray when it has named keys
+//     object               AMFMap (class names are dropped)
+//     bytearray            []byte
+//     vector int/uint/dbl  []int32, []uint32, []float64
+//     vector object        AMFVector
+//     dictionary           AMFDictionary
+
+type AMFVector struct {
+	TypeName string
+	Fixed    bool
+	Items    []interface{}
+}
+
+type AMFDictionaryEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+type AMFDictionary []AMFDictionaryEntry
+
+const (
+	amf3IntegerMin = -(1 << 28)
+	amf3IntegerMax = 1<<28 - 1
+)
+
+func amf3ParseErr(message string, offset int, err error) error {
+	return amf0ParseErr("amf3."+message, offset, err)
+}
+
+func parseU29(b []byte) (val uint32, n int, ok bool) {
+	for n < 4 {
+		if len(b) <= n {
+			return
+		}
+		c := b[n]
+		n++
+		if n == 4 {
+			val = val<<8 | uint32(c)
+			ok = true
+			return
+		}
+		val = val<<7 | uint32(c&0x7f)
+		if c&0x80 == 0 {
+			ok = true
+			return
+		}
+	}
+	return
+}
+
+func lenU29(val uint32) int {
+	switch {
+	case val < 0x80:
+		return 1
+	case val < 0x4000:
+		return 2
+	case val < 0x200000:
+		return 3
+	}
+	return 4
+}
+
+func fillU29(b []byte, val uint32) (n int) {
+	switch lenU29(val) {
+	case 1:
+		b[0] = byte(val)
+	case 2:
+		b[0] = byte(val>>7) | 0x80
+		b[1] = byte(val & 0x7f)
+	case 3:
+		b[0] = byte(val>>14) | 0x80
+		b[1] = byte(val>>7) | 0x80
+		b[2] = byte(val & 0x7f)
+	default:
+		b[0] = byte(val>>22) | 0x80
+		b[1] = byte(val>>15) | 0x80
+		b[2] = byte(val>>8) | 0x80
+		b[3] = byte(val)
+	}
+	return lenU29(val)
+}
+
+type amf3Traits struct {
+	classname      string
+	externalizable bool
+	dynamic        bool
+	members        []string
+}
+
+// amf3Decoder keeps the reference tables, they live as long as one
+// top level value.
+type amf3Decoder struct {
+	strs   []string
+	objs   []interface{}
+	traits []*amf3Traits
+}
+
+func ParseAMF3Val(b []byte) (val interface{}, n int, err error) {
+	d := &amf3Decoder{}
+	return d.parseVal(b, 0)
+}
+
+func (self *amf3Decoder) parseU29(b []byte, n int, offset int, message string) (val uint32, size int, err error) {
+	var ok bool
+	if val, size, ok = parseU29(b[n:]); !ok {
+		err = amf3ParseErr(message, offset+n, nil)
+	}
+	return
+}
+
+// parseRef reads the U29 header shared by most complex types. The low bit
+// clear means a reference into the object table.
+func (self *amf3Decoder) parseRef(b []byte, n int, offset int, message string) (ref interface{}, isref bool, val uint32, size int, err error) {
+	var u29 uint32
+	if u29, size, err = self.parseU29(b, n, offset, message); err != nil {
+		return
+	}
+	if u29&1 == 0 {
+		idx := int(u29 >> 1)
+		if idx >= len(self.objs) {
+			err = amf3ParseErr(message+".ref", offset+n, nil)
+			return
+		}
+		ref = self.objs[idx]
+		isref = true
+		return
+	}
+	val = u29 >> 1
+	return
+}
+
+func (self *amf3Decoder) parseString(b []byte, offset int) (val string, n int, err error) {
+	var u29 uint32
+	var size int
+	if u29, size, err = self.parseU29(b, n, offset, "string.length"); err != nil {
+		return
+	}
+	n += size
+
+	if u29&1 == 0 {
+		idx := int(u29 >> 1)
+		if idx >= len(self.strs) {
+			err = amf3ParseErr("string.ref", offset+n, nil)
+			return
+		}
+		val = self.strs[idx]
+		return
+	}
+
+	length := int(u29 >> 1)
+	if len(b) < n+length {
+		err = amf3ParseErr("string.body", offset+n, nil)
+		return
+	}
+	val = string(b[n : n+length])
+	n += length
+	if length > 0 {
+		self.strs = append(self.strs, val)
+	}
+	return
+}
+
+func (self *amf3Decoder) parseVal(b []byte, offset int) (val interface{}, n int, err error) {
+	if len(b) < n+1 {
+		err = amf3ParseErr("marker", offset+n, nil)
+		return
+	}
+	marker := b[n]
+	n++
+
+	var size int
+
+	switch marker {
+	case amf3undefinedmarker, amf3nullmarker:
+
+	case amf3falsemarker:
+		val = false
+
+	case amf3truemarker:
+		val = true
+
+	case amf3integermarker:
+		var u29 uint32
+		if u29, size, err = self.parseU29(b, n, offset, "integer"); err != nil {
+			return
+		}
+		n += size
+		i := int32(u29)
+		if u29&0x10000000 != 0 {
+			i = int32(u29) - 0x20000000
+		}
+		val = float64(i)
+
+	case amf3doublemarker:
+		if len(b) < n+8 {
+			err = amf3ParseErr("double", offset+n, nil)
+			return
+		}
+		val = parseBEFloat64(b[n:])
+		n += 8
+
+	case amf3stringmarker:
+		if val, size, err = self.parseString(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3xmldocmarker, amf3xmlmarker:
+		var ref interface{}
+		var isref bool
+		var length uint32
+		if ref, isref, length, size, err = self.parseRef(b, n, offset, "xml"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			val = ref
+			return
+		}
+		if len(b) < n+int(length) {
+			err = amf3ParseErr("xml.body", offset+n, nil)
+			return
+		}
+		val = string(b[n : n+int(length)])
+		n += int(length)
+		self.objs = append(self.objs, val)
+
+	case amf3datemarker:
+		var ref interface{}
+		var isref bool
+		if ref, isref, _, size, err = self.parseRef(b, n, offset, "date"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			val = ref
+			return
+		}
+		if len(b) < n+8 {
+			err = amf3ParseErr("date.body", offset+n, nil)
+			return
+		}
+		ts := parseBEFloat64(b[n:])
+		n += 8
+		val = time.Unix(int64(ts/1000), (int64(ts)%1000)*1000000)
+		self.objs = append(self.objs, val)
+
+	case amf3arraymarker:
+		if val, size, err = self.parseArray(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3objectmarker:
+		if val, size, err = self.parseObject(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3bytearraymarker:
+		var ref interface{}
+		var isref bool
+		var length uint32
+		if ref, isref, length, size, err = self.parseRef(b, n, offset, "bytearray"); err != nil {
+			return
+		}
+		n += size
+		if isref {
+			val = ref
+			return
+		}
+		if len(b) < n+int(length) {
+			err = amf3ParseErr("bytearray.body", offset+n, nil)
+			return
+		}
+		val = append([]byte(nil), b[n:n+int(length)]...)
+		n += int(length)
+		self.objs = append(self.objs, val)
+
+	case amf3vectorintmarker, amf3vectoruintmarker, amf3vectordoublemarker, amf3vectorobjectmarker:
+		if val, size, err = self.parseVector(marker, b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	case amf3dictionarymarker:
+		if val, size, err = self.parseDictionary(b[n:], offset+n); err != nil {
+			return
+		}
+		n += size
+
+	default:
+		err = amf3ParseErr(fmt.Sprintf("invalidmarker=%d", marker), offset+n, nil)
+		return
+	}
+
+	return
+}
+
+func (self *amf3Decoder) parseArray(b []byte, offset int) (val interface{}, n int, err error) {
+	var ref interface{}
+	var isref bool
+	var count uint32
+	var size int
+	if ref, isref, count, size, err = self.parseRef(b, n, offset, "array"); err != nil {
+		return
+	}
+	n += size
+	if isref {
+		val = ref
+		return
+	}
+
+	// the associative part comes first, terminated by an empty key
+	var assoc AMFECMAArray
+	idx := len(self.objs)
+	self.objs = append(self.objs, nil)
+	for {
+		var key string
+		if key, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("array.key", offset+n, err)
+			return
+		}
+		n += size
+		if key == "" {
+			break
+		}
+		if assoc == nil {
+			assoc = AMFECMAArray{}
+			self.objs[idx] = assoc
+		}
+		var oval interface{}
+		if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("array.val", offset+n, err)
+			return
+		}
+		n += size
+		assoc[key] = oval
+	}
+
+	if int(count) > len(b)-n {
+		err = amf3ParseErr("array.count", offset+n, nil)
+		return
+	}
+	dense := make(AMFArray, count)
+	if assoc == nil {
+		self.objs[idx] = dense
+	}
+	for i := range dense {
+		if dense[i], size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("array.item", offset+n, err)
+			return
+		}
+		n += size
+	}
+
+	if assoc != nil {
+		for i, item := range dense {
+			assoc[strconv.Itoa(i)] = item
+		}
+		val = assoc
+	} else {
+		val = dense
+	}
+	return
+}
+
+// well known externalizable flex classes which only wrap one value
+var amf3ExternalizableProxies = map[string]bool{
+	"flex.messaging.io.ArrayCollection": true,
+	"flex.messaging.io.ObjectProxy":     true,
+}
+
+func (self *amf3Decoder) parseObject(b []byte, offset int) (val interface{}, n int, err error) {
+	var u29 uint32
+	var size int
+	if u29, size, err = self.parseU29(b, n, offset, "object"); err != nil {
+		return
+	}
+	n += size
+
+	if u29&1 == 0 {
+		idx := int(u29 >> 1)
+		if idx >= len(self.objs) {
+			err = amf3ParseErr("object.ref", offset+n, nil)
+			return
+		}
+		val = self.objs[idx]
+		return
+	}
+
+	var traits *amf3Traits
+	if u29&2 == 0 {
+		idx := int(u29 >> 2)
+		if idx >= len(self.traits) {
+			err = amf3ParseErr("object.traits.ref", offset+n, nil)
+			return
+		}
+		traits = self.traits[idx]
+	} else {
+		traits = &amf3Traits{
+			externalizable: u29&4 != 0,
+			dynamic:        u29&8 != 0,
+		}
+		if traits.classname, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.classname", offset+n, err)
+			return
+		}
+		n += size
+		if !traits.externalizable {
+			count := int(u29 >> 4)
+			if count > len(b)-n {
+				err = amf3ParseErr("object.traits.count", offset+n, nil)
+				return
+			}
+			traits.members = make([]string, count)
+			for i := range traits.members {
+				if traits.members[i], size, err = self.parseString(b[n:], offset+n); err != nil {
+					err = amf3ParseErr("object.traits.member", offset+n, err)
+					return
+				}
+				n += size
+			}
+		}
+		self.traits = append(self.traits, traits)
+	}
+
+	if traits.externalizable {
+		if !amf3ExternalizableProxies[traits.classname] {
+			err = amf3ParseErr(fmt.Sprintf("object.externalizable=%s", traits.classname), offset+n, nil)
+			return
+		}
+		idx := len(self.objs)
+		self.objs = append(self.objs, nil)
+		if val, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.externalizable.val", offset+n, err)
+			return
+		}
+		n += size
+		self.objs[idx] = val
+		return
+	}
+
+	obj := AMFMap{}
+	self.objs = append(self.objs, obj)
+
+	for _, key := range traits.members {
+		var oval interface{}
+		if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("object.val", offset+n, err)
+			return
+		}
+		n += size
+		obj[key] = oval
+	}
+
+	if traits.dynamic {
+		for {
+			var key string
+			if key, size, err = self.parseString(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("object.key", offset+n, err)
+				return
+			}
+			n += size
+			if key == "" {
+				break
+			}
+			var oval interface{}
+			if oval, size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("object.val", offset+n, err)
+				return
+			}
+			n += size
+			obj[key] = oval
+		}
+	}
+
+	val = obj
+	return
+}
+
+func (self *amf3Decoder) parseVector(marker uint8, b []byte, offset int) (val interface{}, n int, err error) {
+	var ref interface{}
+	var isref bool
+	var count uint32
+	var size int
+	if ref, isref, count, size, err = self.parseRef(b, n, offset, "vector"); err != nil {
+		return
+	}
+	n += size
+	if isref {
+		val = ref
+		return
+	}
+
+	if len(b) < n+1 {
+		err = amf3ParseErr("vector.fixed", offset+n, nil)
+		return
+	}
+	fixed := b[n] != 0
+	n++
+
+	itemsize := 0
+	switch marker {
+	case amf3vectorintmarker, amf3vectoruintmarker:
+		itemsize = 4
+	case amf3vectordoublemarker:
+		itemsize = 8
+	}
+	if itemsize > 0 && len(b) < n+int(count)*itemsize {
+		err = amf3ParseErr("vector.body", offset+n, nil)
+		return
+	}
+
+	switch marker {
+	case amf3vectorintmarker:
+		items := make([]int32, count)
+		for i := range items {
+			items[i] = pio.I32BE(b[n:])
+			n += 4
+		}
+		val = items
+
+	case amf3vectoruintmarker:
+		items := make([]uint32, count)
+		for i := range items {
+			items[i] = pio.U32BE(b[n:])
+			n += 4
+		}
+		val = items
+
+	case amf3vectordoublemarker:
+		items := make([]float64, count)
+		for i := range items {
+			items[i] = parseBEFloat64(b[n:])
+			n += 8
+		}
+		val = items
+
+	case amf3vectorobjectmarker:
+		vec := AMFVector{Fixed: fixed}
+		if vec.TypeName, size, err = self.parseString(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("vector.typename", offset+n, err)
+			return
+		}
+		n += size
+		if int(count) > len(b)-n {
+			err = amf3ParseErr("vector.count", offset+n, nil)
+			return
+		}
+		vec.Items = make([]interface{}, count)
+		idx := len(self.objs)
+		self.objs = append(self.objs, nil)
+		for i := range vec.Items {
+			if vec.Items[i], size, err = self.parseVal(b[n:], offset+n); err != nil {
+				err = amf3ParseErr("vector.item", offset+n, err)
+				return
+			}
+			n += size
+		}
+		self.objs[idx] = vec
+		val = vec
+		return
+	}
+
+	self.objs = append(self.objs, val)
+	return
+}
+
+func (self *amf3Decoder) parseDictionary(b []byte, offset int) (val interface{}, n int, err error) {
+	var ref interface{}
+	var isref bool
+	var count uint32
+	var size int
+	if ref, isref, count, size, err = self.parseRef(b, n, offset, "dictionary"); err != nil {
+		return
+	}
+	n += size
+	if isref {
+		val = ref
+		return
+	}
+
+	// weak keys flag
+	if len(b) < n+1 {
+		err = amf3ParseErr("dictionary.weakkeys", offset+n, nil)
+		return
+	}
+	n++
+
+	if int(count) > len(b)-n {
+		err = amf3ParseErr("dictionary.count", offset+n, nil)
+		return
+	}
+	dict := make(AMFDictionary, count)
+	idx := len(self.objs)
+	self.objs = append(self.objs, nil)
+	for i := range dict {
+		if dict[i].Key, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("dictionary.key", offset+n, err)
+			return
+		}
+		n += size
+		if dict[i].Value, size, err = self.parseVal(b[n:], offset+n); err != nil {
+			err = amf3ParseErr("dictionary.val", offset+n, err)
+			return
+		}
+		n += size
+	}
+	self.objs[idx] = dict
+	val = dict
+	return
+}
+
+// amf3Encoder writes into b, or only counts bytes when b is nil, so
+// LenAMF3Val and FillAMF3Val share one code path. Strings are written by
+// reference after their first occurrence, objects and traits are always
+// written inline.
+type amf3Encoder struct {
+	b    []byte
+	n    int
+	strs map[string]int
+}
+
+func LenAMF3Val(val interface{}) int {
+	e := &amf3Encoder{}
+	e.writeVal(val)
+	return e.n
+}
+
+func FillAMF3Val(b []byte, val interface{}) int {
+	e := &amf3Encoder{b: b}
+	e.writeVal(val)
+	return e.n
+}
+
+func (self *amf3Encoder) writeByte(c byte) {
+	if self.b != nil {
+		self.b[self.n] = c
+	}
+	self.n++
+}
+
+func (self *amf3Encoder) writeBytes(p []byte) {
+	if self.b != nil {
+		copy(self.b[self.n:], p)
+	}
+	self.n += len(p)
+}
+
+func (self *amf3Encoder) writeU29(val uint32) {
+	if self.b != nil {
+		fillU29(self.b[self.n:], val)
+	}
+	self.n += lenU29(val)
+}
+
+func (self *amf3Encoder) writeDouble(f float64) {
+	if self.b != nil {
+		fillBEFloat64(self.b[self.n:], f)
+	}
+	self.n += 8
+}
+
+func (self *amf3Encoder) writeString(s string) {
+	if s != "" {
+		if self.strs == nil {
+			self.strs = map[string]int{}
+		}
+		if idx, ok := self.strs[s]; ok {
+			self.writeU29(uint32(idx) << 1)
+			return
+		}
+		self.strs[s] = len(self.strs)
+	}
+	self.writeU29(uint32(len(s))<<1 | 1)
+	self.writeBytes([]byte(s))
+}
+
+func (self *amf3Encoder) writeNumber(i int64, f float64, isint bool) {
+	if isint && i >= amf3IntegerMin && i <= amf3IntegerMax {
+		self.writeByte(amf3integermarker)
+		self.writeU29(uint32(i) & 0x1fffffff)
+	} else {
+		self.writeByte(amf3doublemarker)
+		self.writeDouble(f)
+	}
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (self *amf3Encoder) writeVal(_val interface{}) {
+	switch val := _val.(type) {
+	case int8:
+		self.writeNumber(int64(val), float64(val), true)
+	case int16:
+		self.writeNumber(int64(val), float64(val), true)
+	case int32:
+		self.writeNumber(int64(val), float64(val), true)
+	case int64:
+		self.writeNumber(val, float64(val), true)
+	case int:
+		self.writeNumber(int64(val), float64(val), true)
+	case uint8:
+		self.writeNumber(int64(val), float64(val), true)
+	case uint16:
+		self.writeNumber(int64(val), float64(val), true)
+	case uint32:
+		self.writeNumber(int64(val), float64(val), true)
+	case uint64:
+		self.writeNumber(int64(val), float64(val), val <= amf3IntegerMax)
+	case uint:
+		self.writeNumber(int64(val), float64(val), val <= amf3IntegerMax)
+	case float32:
+		self.writeNumber(0, float64(val), false)
+	case float64:
+		self.writeNumber(0, val, false)
+
+	case string:
+		self.writeByte(amf3stringmarker)
+		self.writeString(val)
+
+	case bool:
+		if val {
+			self.writeByte(amf3truemarker)
+		} else {
+			self.writeByte(amf3falsemarker)
+		}
+
+	case nil:
+		self.writeByte(amf3nullmarker)
+
+	case time.Time:
+		self.writeByte(amf3datemarker)
+		self.writeU29(1)
+		self.writeDouble(float64(val.UnixNano() / 1000000))
+
+	case AMFMap:
+		// anonymous dynamic object without sealed members
+		self.writeByte(amf3objectmarker)
+		self.writeU29(0x0b)
+		self.writeString("")
+		for _, k := range sortedKeys(val) {
+			if len(k) > 0 {
+				self.writeString(k)
+				self.writeVal(val[k])
+			}
+		}
+		self.writeString("")
+
+	case AMFECMAArray:
+		self.writeByte(amf3arraymarker)
+		self.writeU29(1)
+		for _, k := range sortedKeys(val) {
+			if len(k) > 0 {
+				self.writeString(k)
+				self.writeVal(val[k])
+			}
+		}
+		self.writeString("")
+
+	case AMFArray:
+		self.writeByte(amf3arraymarker)
+		self.writeU29(uint32(len(val))<<1 | 1)
+		self.writeString("")
+		for _, v := range val {
+			self.writeVal(v)
+		}
+
+	case []byte:
+		self.writeByte(amf3bytearraymarker)
+		self.writeU29(uint32(len(val))<<1 | 1)
+		self.writeBytes(val)
+
+	case []int32:
+		self.writeByte(amf3vectorintmarker)
+		self.writeU29(uint32(len(val))<<1 | 1)
+		self.writeByte(0)
+		for _, v := range val {
+			var b [4]byte
+			pio.PutI32BE(b[:], v)
+			self.writeBytes(b[:])
+		}
+
+	case []uint32:
+		self.writeByte(amf3vectoruintmarker)
+		self.writeU29(uint32(len(val))<<1 | 1)
+		self.writeByte(0)
+		for _, v := range val {
+			var b [4]byte
+			pio.PutU32BE(b[:], v)
+			self.writeBytes(b[:])
+		}
+
+	case []float64:
+		self.writeByte(amf3vectordoublemarker)
+		self.writeU29(uint32(len(val))<<1 | 1)
+		self.writeByte(0)
+		for _, v := range val {
+			self.writeDouble(v)
+		}
+
+	case AMFVector:
+		self.writeByte(amf3vectorobjectmarker)
+		self.writeU29(uint32(len(val.Items))<<1 | 1)
+		if val.Fixed {
+			self.writeByte(1)
+		} else {
+			self.writeByte(0)
+		}
+		typename := val.TypeName
+		if typename == "" {
+			typename = "*"
+		}
+		self.writeString(typename)
+		for _, v := range val.Items {
+			self.writeVal(v)
+		}
+
+	case AMFDictionary:
+		self.writeByte(amf3dictionarymarker)
+		self.writeU29(uint32(len(val))<<1 | 1)
+		self.writeByte(0)
+		for _, entry := range val {
+			self.writeVal(entry.Key)
+			self.writeVal(entry.Value)
+		}
+
+	default:
+		self.writeByte(amf3undefinedmarker)
+	}
+}
+
+// isAMF3Only reports values which have no AMF0 encoding and are written
+// with the avmplus switch marker.
+func isAMF3Only(val interface{}) bool {
+	switch val.(type) {
+	case []byte, []int32, []uint32, []float64, AMFVector, AMFDictionary:
+		return true
+	}
+	return false
+}
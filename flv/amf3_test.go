@@ -0,0 +1,235 @@
+package flv
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestU29(t *testing.T) {
+	vectors := []struct {
+		val uint32
+		b   []byte
+	}{
+		{0, []byte{0x00}},
+		{0x7f, []byte{0x7f}},
+		{0x80, []byte{0x81, 0x00}},
+		{0x3fff, []byte{0xff, 0x7f}},
+		{0x4000, []byte{0x81, 0x80, 0x00}},
+		{0x1fffff, []byte{0xff, 0xff, 0x7f}},
+		{0x200000, []byte{0x80, 0xc0, 0x80, 0x00}},
+		{0x1fffffff, []byte{0xff, 0xff, 0xff, 0xff}},
+	}
+	for _, v := range vectors {
+		b := make([]byte, 4)
+		n := fillU29(b, v.val)
+		if !bytes.Equal(b[:n], v.b) || lenU29(v.val) != n {
+			t.Errorf("fillU29(%#x) = % x, want % x", v.val, b[:n], v.b)
+		}
+		val, n, ok := parseU29(v.b)
+		if !ok || val != v.val || n != len(v.b) {
+			t.Errorf("parseU29(% x) = %#x %d %v, want %#x", v.b, val, n, ok, v.val)
+		}
+	}
+
+	if _, _, ok := parseU29([]byte{0x81, 0x80}); ok {
+		t.Errorf("parseU29 of a truncated value succeeded")
+	}
+}
+
+func TestAMF3Decode(t *testing.T) {
+	pt1 := AMFMap{"x": float64(1)}
+	obj := AMFMap{"a": float64(1)}
+
+	vectors := []struct {
+		name string
+		b    []byte
+		val  interface{}
+	}{
+		{"null", []byte{0x01}, nil},
+		{"true", []byte{0x03}, true},
+		{"integer", []byte{0x04, 0x01}, float64(1)},
+		{"negative integer", []byte{0x04, 0xff, 0xff, 0xff, 0xff}, float64(-1)},
+		{"double", []byte{0x05, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, 1.5},
+		{"string", []byte{0x06, 0x07, 'f', 'o', 'o'}, "foo"},
+		{
+			"string reference",
+			[]byte{0x09, 0x05, 0x01, 0x06, 0x07, 'f', 'o', 'o', 0x06, 0x00},
+			AMFArray{"foo", "foo"},
+		},
+		{
+			"traits reference",
+			[]byte{
+				0x09, 0x05, 0x01,
+				// sealed class Pt with member x
+				0x0a, 0x13, 0x05, 'P', 't', 0x03, 'x', 0x04, 0x01,
+				// traits 0
+				0x0a, 0x01, 0x04, 0x02,
+			},
+			AMFArray{pt1, AMFMap{"x": float64(2)}},
+		},
+		{
+			"object reference",
+			[]byte{
+				0x09, 0x05, 0x01,
+				// anonymous dynamic object {a: 1}
+				0x0a, 0x0b, 0x01, 0x03, 'a', 0x04, 0x01, 0x01,
+				// object 1, 0 is the array
+				0x0a, 0x02,
+			},
+			AMFArray{obj, obj},
+		},
+		{
+			"ecma array",
+			[]byte{0x09, 0x03, 0x03, 'k', 0x03, 0x01, 0x04, 0x05},
+			AMFECMAArray{"k": true, "0": float64(5)},
+		},
+		{"bytearray", []byte{0x0c, 0x05, 0xde, 0xad}, []byte{0xde, 0xad}},
+		{
+			"vector int",
+			[]byte{0x0d, 0x05, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff},
+			[]int32{1, -1},
+		},
+		{
+			"vector uint",
+			[]byte{0x0e, 0x03, 0x00, 0xff, 0xff, 0xff, 0xff},
+			[]uint32{0xffffffff},
+		},
+		{
+			"vector double",
+			[]byte{0x0f, 0x03, 0x01, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0},
+			[]float64{1.5},
+		},
+		{
+			"vector object",
+			[]byte{0x10, 0x05, 0x00, 0x03, '*', 0x04, 0x01, 0x06, 0x03, 'b'},
+			AMFVector{TypeName: "*", Items: []interface{}{float64(1), "b"}},
+		},
+		{
+			"dictionary",
+			[]byte{0x11, 0x03, 0x00, 0x06, 0x03, 'k', 0x04, 0x07},
+			AMFDictionary{{Key: "k", Value: float64(7)}},
+		},
+	}
+
+	for _, v := range vectors {
+		val, n, err := ParseAMF3Val(v.b)
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		if n != len(v.b) {
+			t.Errorf("%s: parsed %d bytes of %d", v.name, n, len(v.b))
+		}
+		if !reflect.DeepEqual(val, v.val) {
+			t.Errorf("%s: got %#v, want %#v", v.name, val, v.val)
+		}
+	}
+}
+
+func TestAMF3DecodeInvalid(t *testing.T) {
+	vectors := []struct {
+		name string
+		b    []byte
+	}{
+		{"empty", []byte{}},
+		{"invalid marker", []byte{0x20}},
+		{"short double", []byte{0x05, 0x3f}},
+		{"short string", []byte{0x06, 0x07, 'f'}},
+		{"string reference out of range", []byte{0x06, 0x02}},
+		{"object reference out of range", []byte{0x0a, 0x02}},
+		{"traits reference out of range", []byte{0x0a, 0x05}},
+		{"array count past the end", []byte{0x09, 0xff, 0xff, 0x7f, 0x01}},
+	}
+	for _, v := range vectors {
+		if _, _, err := ParseAMF3Val(v.b); err == nil {
+			t.Errorf("%s: no error", v.name)
+		}
+	}
+}
+
+func TestAMF3Encode(t *testing.T) {
+	vectors := []struct {
+		name string
+		val  interface{}
+		b    []byte
+	}{
+		{"integer", 1, []byte{0x04, 0x01}},
+		{"negative integer", -1, []byte{0x04, 0xff, 0xff, 0xff, 0xff}},
+		{"large integer", 1 << 28, []byte{0x05, 0x41, 0xb0, 0, 0, 0, 0, 0, 0}},
+		{"double", 1.5, []byte{0x05, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{
+			"string reference",
+			AMFArray{"foo", "foo"},
+			[]byte{0x09, 0x05, 0x01, 0x06, 0x07, 'f', 'o', 'o', 0x06, 0x00},
+		},
+		{
+			"key reference",
+			AMFArray{AMFMap{"a": true}, AMFMap{"a": false}},
+			[]byte{
+				0x09, 0x05, 0x01,
+				0x0a, 0x0b, 0x01, 0x03, 'a', 0x03, 0x01,
+				0x0a, 0x0b, 0x01, 0x00, 0x02, 0x01,
+			},
+		},
+		{"vector int", []int32{1, -1}, []byte{0x0d, 0x05, 0x00, 0x00, 0x00, 0x00, 0x01, 0xff, 0xff, 0xff, 0xff}},
+		{
+			"dictionary",
+			AMFDictionary{{Key: "k", Value: 7}},
+			[]byte{0x11, 0x03, 0x00, 0x06, 0x03, 'k', 0x04, 0x07},
+		},
+	}
+	for _, v := range vectors {
+		n := LenAMF3Val(v.val)
+		b := make([]byte, n)
+		if FillAMF3Val(b, v.val) != n {
+			t.Errorf("%s: LenAMF3Val and FillAMF3Val differ", v.name)
+		}
+		if !bytes.Equal(b, v.b) {
+			t.Errorf("%s: got % x, want % x", v.name, b, v.b)
+		}
+	}
+}
+
+func TestAMF3RoundTrip(t *testing.T) {
+	vals := []interface{}{
+		nil,
+		false,
+		1.25,
+		"",
+		"hello",
+		AMFArray{float64(1), "two", AMFArray{"two"}},
+		AMFECMAArray{"name": "cam", "width": 1280.5},
+		AMFMap{"app": "live", "nested": AMFMap{"app": "live"}, "list": AMFArray{"app"}},
+		[]byte{1, 2, 3},
+		[]int32{-5, 0, 5},
+		[]uint32{0, 1 << 31},
+		[]float64{0.5, -0.5},
+		AMFVector{TypeName: "Point", Fixed: true, Items: []interface{}{AMFMap{"x": 1.5}, "Point"}},
+		AMFDictionary{{Key: "a", Value: AMFArray{"a"}}, {Key: 2.5, Value: nil}},
+	}
+	for _, val := range vals {
+		b := make([]byte, LenAMF3Val(val))
+		FillAMF3Val(b, val)
+		got, n, err := ParseAMF3Val(b)
+		if err != nil {
+			t.Errorf("%#v: %v", val, err)
+			continue
+		}
+		if n != len(b) {
+			t.Errorf("%#v: parsed %d bytes of %d", val, n, len(b))
+		}
+		if !reflect.DeepEqual(got, val) {
+			t.Errorf("got %#v, want %#v", got, val)
+		}
+	}
+
+	date := time.Unix(1500000000, 123000000)
+	b := make([]byte, LenAMF3Val(date))
+	FillAMF3Val(b, date)
+	got, _, err := ParseAMF3Val(b)
+	if tm, ok := got.(time.Time); err != nil || !ok || !tm.Equal(date) {
+		t.Errorf("date: got %v %v, want %v", got, err, date)
+	}
+}
@@ -8,8 +8,16 @@ import (
 
 	"github.com/notedit/rtmp-lib/aac"
 	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/av1"
+	"github.com/notedit/rtmp-lib/g711"
 	"github.com/notedit/rtmp-lib/h264"
+	"github.com/notedit/rtmp-lib/h265"
+	"github.com/notedit/rtmp-lib/mp3"
+	"github.com/notedit/rtmp-lib/nellymoser"
+	"github.com/notedit/rtmp-lib/opus"
 	"github.com/notedit/rtmp-lib/pio"
+	"github.com/notedit/rtmp-lib/speex"
+	"github.com/notedit/rtmp-lib/vp9"
 )
 
 var MaxProbePacketCount = 20
@@ -37,8 +45,10 @@ const (
 	SOUND_NELLYMOSER            = 6
 	SOUND_ALAW                  = 7
 	SOUND_MULAW                 = 8
+	SOUND_EXHEADER              = 9
 	SOUND_AAC                   = 10
 	SOUND_SPEEX                 = 11
+	SOUND_MP3_8KHZ              = 14
 
 	SOUND_5_5Khz = 0
 	SOUND_11Khz  = 1
@@ -64,6 +74,23 @@ const (
 	FRAME_INTER = 2
 
 	VIDEO_H264 = 7
+	// not in the flv spec, used for HEVC by many encoders before enhanced rtmp
+	VIDEO_H265 = 12
+)
+
+// Enhanced RTMP video
+const (
+	PACKETTYPE_SEQUENCE_START         = 0
+	PACKETTYPE_CODED_FRAMES           = 1
+	PACKETTYPE_SEQUENCE_END           = 2
+	PACKETTYPE_CODED_FRAMESX          = 3
+	PACKETTYPE_METADATA               = 4
+	PACKETTYPE_MPEG2TS_SEQUENCE_START = 5
+
+	FOURCC_HVC1 = 0x68766331 // 'hvc1'
+	FOURCC_AV01 = 0x61763031 // 'av01'
+	FOURCC_VP09 = 0x76703039 // 'vp09'
+	FOURCC_OPUS = 0x4f707573 // 'Opus'
 )
 
 type Tag struct {
@@ -80,7 +107,7 @@ type Tag struct {
 		6 = Nellymoser
 		7 = G.711 A-law logarithmic PCM
 		8 = G.711 mu-law logarithmic PCM
-		9 = reserved
+		9 = Enhanced RTMP ExHeader, PacketType and FourCC follow
 		10 = AAC
 		11 = Speex
 		14 = MP3 8-Khz
@@ -143,6 +170,7 @@ type Tag struct {
 		5: On2 VP6 with alpha channel
 		6: Screen video version 2
 		7: AVC
+		12: HEVC (non-standard)
 	*/
 	CodecID uint8
 
@@ -153,6 +181,33 @@ type Tag struct {
 	*/
 	AVCPacketType uint8
 
+	/*
+		IsExHeader: UB[1]
+		Enhanced RTMP, the high bit of FrameType.
+		When set, FrameType is UB[3], the low 4 bits are PacketType
+		and FourCC follows instead of CodecID.
+	*/
+	IsExHeader bool
+
+	/*
+		0: sequence start
+		1: coded frames
+		2: sequence end
+		3: coded frames, composition time is implicitly 0 (video only)
+		4: metadata (video only)
+		5: MPEG2-TS sequence start (video only)
+		The audio PacketType is the low 4 bits after SoundFormat 9.
+	*/
+	PacketType uint8
+
+	/*
+		'hvc1': HEVC
+		'av01': AV1
+		'vp09': VP9
+		'Opus': Opus
+	*/
+	FourCC uint32
+
 	CompositionTime int32
 
 	Data []byte
@@ -166,6 +221,25 @@ func (self Tag) ChannelLayout() av.ChannelLayout {
 	}
 }
 
+var soundRates = [4]int{5512, 11025, 22050, 44100}
+
+// SampleRate is the rate given by the sound flags, codecs that carry their
+// own config (AAC, MP3, Opus) may differ.
+func (self Tag) SampleRate() int {
+	switch self.SoundFormat {
+	case SOUND_ALAW, SOUND_MULAW:
+		// G.711 is 8kHz, SoundRate 0 is how most encoders say so
+		if self.SoundRate == SOUND_5_5Khz {
+			return 8000
+		}
+	case SOUND_NELLYMOSER_16KHZ_MONO, SOUND_SPEEX:
+		return 16000
+	case SOUND_NELLYMOSER_8KHZ_MONO, SOUND_MP3_8KHZ:
+		return 8000
+	}
+	return soundRates[self.SoundRate&0x3]
+}
+
 func (self *Tag) audioParseHeader(b []byte) (n int, err error) {
 	if len(b) < n+1 {
 		err = fmt.Errorf("audiodata: parse invalid")
@@ -175,6 +249,19 @@ func (self *Tag) audioParseHeader(b []byte) (n int, err error) {
 	flags := b[n]
 	n++
 	self.SoundFormat = flags >> 4
+
+	if self.SoundFormat == SOUND_EXHEADER {
+		self.IsExHeader = true
+		self.PacketType = flags & 0xf
+		if len(b) < n+4 {
+			err = fmt.Errorf("audiodata: parse invalid")
+			return
+		}
+		self.FourCC = pio.U32BE(b[n:])
+		n += 4
+		return
+	}
+
 	self.SoundRate = (flags >> 2) & 0x3
 	self.SoundSize = (flags >> 1) & 0x1
 	self.SoundType = flags & 0x1
@@ -193,6 +280,14 @@ func (self *Tag) audioParseHeader(b []byte) (n int, err error) {
 }
 
 func (self Tag) audioFillHeader(b []byte) (n int) {
+	if self.IsExHeader {
+		b[n] = SOUND_EXHEADER<<4 | self.PacketType&0xf
+		n++
+		pio.PutU32BE(b[n:], self.FourCC)
+		n += 4
+		return
+	}
+
 	var flags uint8
 	flags |= self.SoundFormat << 4
 	flags |= self.SoundRate << 2
@@ -216,9 +311,33 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 		return
 	}
 	flags := b[n]
+	n++
+
+	if flags&0x80 != 0 {
+		self.IsExHeader = true
+		self.FrameType = (flags >> 4) & 0x7
+		self.PacketType = flags & 0xf
+
+		if len(b) < n+4 {
+			err = fmt.Errorf("videodata: parse invalid")
+			return
+		}
+		self.FourCC = pio.U32BE(b[n:])
+		n += 4
+
+		if self.PacketType == PACKETTYPE_CODED_FRAMES && self.FourCC == FOURCC_HVC1 {
+			if len(b) < n+3 {
+				err = fmt.Errorf("videodata: parse invalid")
+				return
+			}
+			self.CompositionTime = pio.I24BE(b[n:])
+			n += 3
+		}
+		return
+	}
+
 	self.FrameType = flags >> 4
 	self.CodecID = flags & 0xf
-	n++
 
 	if self.FrameType == FRAME_INTER || self.FrameType == FRAME_KEY {
 		if len(b) < n+4 {
@@ -236,6 +355,18 @@ func (self *Tag) videoParseHeader(b []byte) (n int, err error) {
 }
 
 func (self Tag) videoFillHeader(b []byte) (n int) {
+	if self.IsExHeader {
+		b[n] = 0x80 | (self.FrameType&0x7)<<4 | self.PacketType&0xf
+		n++
+		pio.PutU32BE(b[n:], self.FourCC)
+		n += 4
+		if self.PacketType == PACKETTYPE_CODED_FRAMES && self.FourCC == FOURCC_HVC1 {
+			pio.PutI24BE(b[n:], self.CompositionTime)
+			n += 3
+		}
+		return
+	}
+
 	flags := self.FrameType<<4 | self.CodecID
 	b[n] = flags
 	n++
@@ -427,6 +558,15 @@ func NewMetadataByStreams(streams []av.CodecData) (metadata AMFMap, err error) {
 			case av.H264:
 				metadata["videocodecid"] = VIDEO_H264
 
+			case av.H265:
+				metadata["videocodecid"] = FOURCC_HVC1
+
+			case av.AV1:
+				metadata["videocodecid"] = FOURCC_AV01
+
+			case av.VP9:
+				metadata["videocodecid"] = FOURCC_VP09
+
 			default:
 				err = fmt.Errorf("flv: metadata: unsupported video codecType=%v", stream.Type())
 				return
@@ -446,6 +586,21 @@ func NewMetadataByStreams(streams []av.CodecData) (metadata AMFMap, err error) {
 			case av.SPEEX:
 				metadata["audiocodecid"] = SOUND_SPEEX
 
+			case av.NELLYMOSER:
+				metadata["audiocodecid"] = nellymoserSoundFormat(stream.SampleRate())
+
+			case av.OPUS:
+				metadata["audiocodecid"] = FOURCC_OPUS
+
+			case av.MP3:
+				metadata["audiocodecid"] = mp3SoundFormat(stream)
+
+			case av.PCM_ALAW:
+				metadata["audiocodecid"] = SOUND_ALAW
+
+			case av.PCM_MULAW:
+				metadata["audiocodecid"] = SOUND_MULAW
+
 			default:
 				err = fmt.Errorf("flv: metadata: unsupported audio codecType=%v", stream.Type())
 				return
@@ -482,13 +637,24 @@ func (self *Prober) PushTag(tag Tag, timestamp int32) (err error) {
 
 	switch tag.Type {
 	case TAG_VIDEO:
+		if tag.IsExHeader {
+			return self.pushExVideoTag(tag, timestamp)
+		}
+
 		switch tag.AVCPacketType {
 		case AVC_SEQHDR:
 			if !self.GotVideo {
-				var stream h264.CodecData
-				if stream, err = h264.NewCodecDataFromAVCDecoderConfRecord(tag.Data); err != nil {
-					err = fmt.Errorf("flv: h264 seqhdr invalid")
-					return
+				var stream av.CodecData
+				if tag.CodecID == VIDEO_H265 {
+					if stream, err = h265.NewCodecDataFromHEVCDecoderConfRecord(tag.Data); err != nil {
+						err = fmt.Errorf("flv: h265 seqhdr invalid")
+						return
+					}
+				} else {
+					if stream, err = h264.NewCodecDataFromAVCDecoderConfRecord(tag.Data); err != nil {
+						err = fmt.Errorf("flv: h264 seqhdr invalid")
+						return
+					}
 				}
 				self.VideoStreamIdx = len(self.Streams)
 				self.Streams = append(self.Streams, stream)
@@ -500,6 +666,10 @@ func (self *Prober) PushTag(tag Tag, timestamp int32) (err error) {
 		}
 
 	case TAG_AUDIO:
+		if tag.IsExHeader {
+			return self.pushExAudioTag(tag, timestamp)
+		}
+
 		switch tag.SoundFormat {
 		case SOUND_AAC:
 			switch tag.AACPacketType {
@@ -518,12 +688,150 @@ func (self *Prober) PushTag(tag Tag, timestamp int32) (err error) {
 			case AAC_RAW:
 				self.CacheTag(tag, timestamp)
 			}
+
+		case SOUND_MP3, SOUND_MP3_8KHZ:
+			// no sequence header, the first frame describes the stream
+			if !self.GotAudio {
+				var stream mp3.CodecData
+				if stream, err = mp3.NewCodecDataFromFrame(tag.Data); err != nil {
+					err = fmt.Errorf("flv: mp3 frame invalid")
+					return
+				}
+				self.AudioStreamIdx = len(self.Streams)
+				self.Streams = append(self.Streams, stream)
+				self.GotAudio = true
+			}
+			self.CacheTag(tag, timestamp)
+
+		case SOUND_ALAW, SOUND_MULAW:
+			if !self.GotAudio {
+				typ := av.PCM_ALAW
+				if tag.SoundFormat == SOUND_MULAW {
+					typ = av.PCM_MULAW
+				}
+				var stream g711.CodecData
+				if stream, err = g711.NewCodecData(typ, tag.SampleRate(), tag.ChannelLayout()); err != nil {
+					return
+				}
+				self.AudioStreamIdx = len(self.Streams)
+				self.Streams = append(self.Streams, stream)
+				self.GotAudio = true
+			}
+			self.CacheTag(tag, timestamp)
+
+		case SOUND_SPEEX:
+			if !self.GotAudio {
+				self.AudioStreamIdx = len(self.Streams)
+				self.Streams = append(self.Streams, speex.NewCodecData())
+				self.GotAudio = true
+			}
+			self.CacheTag(tag, timestamp)
+
+		case SOUND_NELLYMOSER, SOUND_NELLYMOSER_16KHZ_MONO, SOUND_NELLYMOSER_8KHZ_MONO:
+			if !self.GotAudio {
+				var stream nellymoser.CodecData
+				if stream, err = nellymoser.NewCodecData(tag.SampleRate()); err != nil {
+					return
+				}
+				self.AudioStreamIdx = len(self.Streams)
+				self.Streams = append(self.Streams, stream)
+				self.GotAudio = true
+			}
+			self.CacheTag(tag, timestamp)
 		}
 	}
 
 	return
 }
 
+func (self *Prober) pushExVideoTag(tag Tag, timestamp int32) (err error) {
+	switch tag.PacketType {
+	case PACKETTYPE_SEQUENCE_START:
+		if self.GotVideo {
+			return
+		}
+
+		var stream av.CodecData
+		switch tag.FourCC {
+		case FOURCC_HVC1:
+			if stream, err = h265.NewCodecDataFromHEVCDecoderConfRecord(tag.Data); err != nil {
+				err = fmt.Errorf("flv: h265 seqhdr invalid")
+				return
+			}
+
+		case FOURCC_AV01:
+			if stream, err = av1.NewCodecDataFromAV1CodecConfRecord(tag.Data); err != nil {
+				err = fmt.Errorf("flv: av1 seqhdr invalid")
+				return
+			}
+
+		case FOURCC_VP09:
+			if stream, err = vp9.NewCodecDataFromVPCodecConfRecord(tag.Data); err != nil {
+				err = fmt.Errorf("flv: vp9 seqhdr invalid")
+				return
+			}
+
+		default:
+			err = fmt.Errorf("flv: video fourcc=%08x unsupported", tag.FourCC)
+			return
+		}
+		self.VideoStreamIdx = len(self.Streams)
+		self.Streams = append(self.Streams, stream)
+		self.GotVideo = true
+
+	case PACKETTYPE_CODED_FRAMES, PACKETTYPE_CODED_FRAMESX:
+		// vpcC has no frame size, take it from the first keyframe
+		if self.GotVideo && tag.FourCC == FOURCC_VP09 && tag.FrameType == FRAME_KEY {
+			if stream, ok := self.Streams[self.VideoStreamIdx].(vp9.CodecData); ok && stream.Width() == 0 {
+				self.Streams[self.VideoStreamIdx] = stream.WithKeyFrame(tag.Data)
+			}
+		}
+		self.CacheTag(tag, timestamp)
+	}
+
+	return
+}
+
+func (self *Prober) pushExAudioTag(tag Tag, timestamp int32) (err error) {
+	if tag.FourCC != FOURCC_OPUS {
+		err = fmt.Errorf("flv: audio fourcc=%08x unsupported", tag.FourCC)
+		return
+	}
+
+	switch tag.PacketType {
+	case PACKETTYPE_SEQUENCE_START:
+		if !self.GotAudio {
+			var stream opus.CodecData
+			if stream, err = opus.NewCodecDataFromOpusHead(tag.Data); err != nil {
+				err = fmt.Errorf("flv: opus seqhdr invalid")
+				return
+			}
+			self.AudioStreamIdx = len(self.Streams)
+			self.Streams = append(self.Streams, stream)
+			self.GotAudio = true
+		}
+
+	case PACKETTYPE_CODED_FRAMES:
+		// the sequence start is optional for opus, guess the channels from
+		// the TOC stereo flag. The guess is mono or stereo only, a stream of
+		// more channels needs the OpusHead of a sequence start for its
+		// channel mapping.
+		if !self.GotAudio && len(tag.Data) > 0 {
+			channels := 1
+			if tag.Data[0]&0x4 != 0 {
+				channels = 2
+			}
+			stream, _ := opus.NewCodecData(channels)
+			self.AudioStreamIdx = len(self.Streams)
+			self.Streams = append(self.Streams, stream)
+			self.GotAudio = true
+		}
+		self.CacheTag(tag, timestamp)
+	}
+
+	return
+}
+
 func (self *Prober) Probed() (ok bool) {
 	if self.HasAudio || self.HasVideo {
 		if self.HasAudio == self.GotAudio && self.HasVideo == self.GotVideo {
@@ -541,6 +849,17 @@ func (self *Prober) TagToPacket(tag Tag, timestamp int32) (pkt av.Packet, ok boo
 	switch tag.Type {
 	case TAG_VIDEO:
 		pkt.Idx = int8(self.VideoStreamIdx)
+		if tag.IsExHeader {
+			switch tag.PacketType {
+			case PACKETTYPE_CODED_FRAMES, PACKETTYPE_CODED_FRAMESX:
+				ok = true
+				pkt.Data = tag.Data
+				pkt.CompositionTime = TsToTime(tag.CompositionTime)
+				pkt.IsKeyFrame = tag.FrameType == FRAME_KEY
+			}
+			break
+		}
+
 		switch tag.AVCPacketType {
 		case AVC_NALU:
 			ok = true
@@ -551,6 +870,15 @@ func (self *Prober) TagToPacket(tag Tag, timestamp int32) (pkt av.Packet, ok boo
 
 	case TAG_AUDIO:
 		pkt.Idx = int8(self.AudioStreamIdx)
+		if tag.IsExHeader {
+			switch tag.PacketType {
+			case PACKETTYPE_CODED_FRAMES:
+				ok = true
+				pkt.Data = tag.Data
+			}
+			break
+		}
+
 		switch tag.SoundFormat {
 		case SOUND_AAC:
 			switch tag.AACPacketType {
@@ -563,7 +891,15 @@ func (self *Prober) TagToPacket(tag Tag, timestamp int32) (pkt av.Packet, ok boo
 			ok = true
 			pkt.Data = tag.Data
 
-		case SOUND_NELLYMOSER:
+		case SOUND_MP3, SOUND_MP3_8KHZ:
+			ok = true
+			pkt.Data = tag.Data
+
+		case SOUND_ALAW, SOUND_MULAW:
+			ok = true
+			pkt.Data = tag.Data
+
+		case SOUND_NELLYMOSER, SOUND_NELLYMOSER_16KHZ_MONO, SOUND_NELLYMOSER_8KHZ_MONO:
 			ok = true
 			pkt.Data = tag.Data
 		}
@@ -597,8 +933,34 @@ func CodecDataToTag(stream av.CodecData) (_tag Tag, ok bool, err error) {
 		ok = true
 		_tag = tag
 
-	case av.NELLYMOSER:
-	case av.SPEEX:
+	case av.H265:
+		codec := stream.(h265.CodecData)
+		_tag = exVideoSeqHdrTag(FOURCC_HVC1, codec.HEVCDecoderConfRecordBytes())
+		ok = true
+
+	case av.AV1:
+		codec := stream.(av1.CodecData)
+		_tag = exVideoSeqHdrTag(FOURCC_AV01, codec.AV1CodecConfRecordBytes())
+		ok = true
+
+	case av.VP9:
+		codec := stream.(vp9.CodecData)
+		_tag = exVideoSeqHdrTag(FOURCC_VP09, codec.VPCodecConfRecordBytes())
+		ok = true
+
+	case av.OPUS:
+		codec := stream.(opus.CodecData)
+		_tag = Tag{
+			Type:       TAG_AUDIO,
+			IsExHeader: true,
+			PacketType: PACKETTYPE_SEQUENCE_START,
+			FourCC:     FOURCC_OPUS,
+			Data:       codec.OpusHeadBytes(),
+		}
+		ok = true
+
+	// no decoder config, the sound flags of every packet describe the stream
+	case av.NELLYMOSER, av.SPEEX, av.MP3, av.PCM_ALAW, av.PCM_MULAW:
 
 	case av.AAC:
 		codec := stream.(aac.CodecData)
@@ -631,8 +993,85 @@ func CodecDataToTag(stream av.CodecData) (_tag Tag, ok bool, err error) {
 	return
 }
 
+func exVideoSeqHdrTag(fourcc uint32, record []byte) Tag {
+	return Tag{
+		Type:       TAG_VIDEO,
+		IsExHeader: true,
+		FrameType:  FRAME_KEY,
+		PacketType: PACKETTYPE_SEQUENCE_START,
+		FourCC:     fourcc,
+		Data:       record,
+	}
+}
+
+// CodecFourCC returns the enhanced rtmp FourCC of a codec, 0 for codecs
+// sent with the legacy CodecID or SoundFormat.
+func CodecFourCC(typ av.CodecType) uint32 {
+	switch typ {
+	case av.H265:
+		return FOURCC_HVC1
+	case av.AV1:
+		return FOURCC_AV01
+	case av.VP9:
+		return FOURCC_VP09
+	case av.OPUS:
+		return FOURCC_OPUS
+	}
+	return 0
+}
+
+func nellymoserSoundFormat(rate int) uint8 {
+	switch rate {
+	case 16000:
+		return SOUND_NELLYMOSER_16KHZ_MONO
+	case 8000:
+		return SOUND_NELLYMOSER_8KHZ_MONO
+	}
+	return SOUND_NELLYMOSER
+}
+
+func mp3SoundFormat(stream av.AudioCodecData) uint8 {
+	if stream.SampleRate() == 8000 {
+		return SOUND_MP3_8KHZ
+	}
+	return SOUND_MP3
+}
+
+// soundRateFlag picks the nearest SoundRate, the real rate is in the codec
+// bitstream anyway.
+func soundRateFlag(rate int) uint8 {
+	switch {
+	case rate >= 44100:
+		return SOUND_44Khz
+	case rate >= 22050:
+		return SOUND_22Khz
+	case rate >= 11025:
+		return SOUND_11Khz
+	default:
+		return SOUND_5_5Khz
+	}
+}
+
 func PacketToTag(pkt av.Packet, stream av.CodecData) (tag Tag, timestamp int32) {
 	switch stream.Type() {
+	case av.H265, av.AV1, av.VP9:
+		tag = Tag{
+			Type:            TAG_VIDEO,
+			IsExHeader:      true,
+			PacketType:      PACKETTYPE_CODED_FRAMES,
+			FourCC:          CodecFourCC(stream.Type()),
+			Data:            pkt.Data,
+			CompositionTime: TimeToTs(pkt.CompositionTime),
+		}
+		if tag.FourCC == FOURCC_HVC1 && tag.CompositionTime == 0 {
+			tag.PacketType = PACKETTYPE_CODED_FRAMESX
+		}
+		if pkt.IsKeyFrame {
+			tag.FrameType = FRAME_KEY
+		} else {
+			tag.FrameType = FRAME_INTER
+		}
+
 	case av.H264:
 		tag = Tag{
 			Type:            TAG_VIDEO,
@@ -669,17 +1108,66 @@ func PacketToTag(pkt av.Packet, stream av.CodecData) (tag Tag, timestamp int32)
 			tag.SoundType = SOUND_STEREO
 		}
 
+	case av.OPUS:
+		tag = Tag{
+			Type:       TAG_AUDIO,
+			IsExHeader: true,
+			PacketType: PACKETTYPE_CODED_FRAMES,
+			FourCC:     FOURCC_OPUS,
+			Data:       pkt.Data,
+		}
+
+	case av.MP3:
+		astream := stream.(av.AudioCodecData)
+		tag = Tag{
+			Type:        TAG_AUDIO,
+			SoundFormat: mp3SoundFormat(astream),
+			SoundRate:   soundRateFlag(astream.SampleRate()),
+			SoundSize:   SOUND_16BIT,
+			Data:        pkt.Data,
+		}
+		if astream.ChannelLayout().Count() == 1 {
+			tag.SoundType = SOUND_MONO
+		} else {
+			tag.SoundType = SOUND_STEREO
+		}
+
+	case av.PCM_ALAW, av.PCM_MULAW:
+		astream := stream.(av.AudioCodecData)
+		tag = Tag{
+			Type:        TAG_AUDIO,
+			SoundFormat: SOUND_ALAW,
+			SoundRate:   soundRateFlag(astream.SampleRate()),
+			SoundSize:   SOUND_16BIT,
+			Data:        pkt.Data,
+		}
+		if stream.Type() == av.PCM_MULAW {
+			tag.SoundFormat = SOUND_MULAW
+		}
+		if astream.ChannelLayout().Count() == 1 {
+			tag.SoundType = SOUND_MONO
+		} else {
+			tag.SoundType = SOUND_STEREO
+		}
+
 	case av.SPEEX:
 		tag = Tag{
 			Type:        TAG_AUDIO,
 			SoundFormat: SOUND_SPEEX,
+			SoundRate:   SOUND_5_5Khz,
+			SoundSize:   SOUND_16BIT,
+			SoundType:   SOUND_MONO,
 			Data:        pkt.Data,
 		}
 
 	case av.NELLYMOSER:
+		rate := stream.(av.AudioCodecData).SampleRate()
 		tag = Tag{
 			Type:        TAG_AUDIO,
-			SoundFormat: SOUND_NELLYMOSER,
+			SoundFormat: nellymoserSoundFormat(rate),
+			SoundRate:   soundRateFlag(rate),
+			SoundSize:   SOUND_16BIT,
+			SoundType:   SOUND_MONO,
 			Data:        pkt.Data,
 		}
 	}
@@ -710,7 +1198,7 @@ func NewMuxer(w io.Writer) *Muxer {
 	return NewMuxerWriteFlusher(bufio.NewWriterSize(w, 1024*64))
 }
 
-var CodecTypes = []av.CodecType{av.H264, av.AAC, av.SPEEX}
+var CodecTypes = []av.CodecType{av.H264, av.H265, av.AV1, av.VP9, av.AAC, av.SPEEX, av.NELLYMOSER, av.OPUS, av.MP3, av.PCM_ALAW, av.PCM_MULAW}
 
 func (self *Muxer) WriteHeader(streams []av.CodecData) (err error) {
 	var flags uint8
@@ -763,14 +1251,44 @@ func (self *Muxer) WriteTrailer() (err error) {
 
 type Demuxer struct {
 	prober *Prober
+	r      *countReader
 	bufr   *bufio.Reader
 	b      []byte
 	stage  int
+
+	// offset of the first tag, for SeekToTime
+	dataoff int64
+	// seek points of SeekToTime, from the keyframes of onMetaData or
+	// scanned on the first seek
+	index     []seekPoint
+	indexed   bool
+	metaindex bool
+}
+
+type seekPoint struct {
+	time   time.Duration
+	offset int64
+}
+
+// countReader tracks the offset of the underlying reader, what bufr has
+// consumed is offset minus bufr.Buffered().
+type countReader struct {
+	io.Reader
+	offset int64
+}
+
+func (self *countReader) Read(p []byte) (n int, err error) {
+	n, err = self.Reader.Read(p)
+	self.offset += int64(n)
+	return
 }
 
+// NewDemuxer reads flv from r, SeekToTime works when r is an io.Seeker.
 func NewDemuxer(r io.Reader) *Demuxer {
+	cr := &countReader{Reader: r}
 	return &Demuxer{
-		bufr:   bufio.NewReaderSize(r, 1024*10),
+		r:      cr,
+		bufr:   bufio.NewReaderSize(cr, 1024*10),
 		prober: &Prober{},
 		b:      make([]byte, 256),
 	}
@@ -791,6 +1309,7 @@ func (self *Demuxer) prepare() (err error) {
 			if _, err = self.bufr.Discard(skip); err != nil {
 				return
 			}
+			self.dataoff = self.offset()
 			if flags&FILE_HAS_AUDIO != 0 {
 				self.prober.HasAudio = true
 			}
@@ -806,6 +1325,9 @@ func (self *Demuxer) prepare() (err error) {
 				if tag, timestamp, err = ReadTag(self.bufr, self.b); err != nil {
 					return
 				}
+				if tag.Type == TAG_SCRIPTDATA && !self.indexed {
+					self.readMetaIndex(tag.Data)
+				}
 				if err = self.prober.PushTag(tag, timestamp); err != nil {
 					return
 				}
@@ -816,6 +1338,196 @@ func (self *Demuxer) prepare() (err error) {
 	return
 }
 
+func (self *Demuxer) offset() int64 {
+	return self.r.offset - int64(self.bufr.Buffered())
+}
+
+func (self *Demuxer) seek(offset int64) (err error) {
+	seeker, ok := self.r.Reader.(io.Seeker)
+	if !ok {
+		err = fmt.Errorf("flv: demuxer input is not seekable")
+		return
+	}
+	if _, err = seeker.Seek(offset, io.SeekStart); err != nil {
+		return
+	}
+	self.r.offset = offset
+	self.bufr.Reset(self.r)
+	return
+}
+
+// isSeekPoint tells if playback can start at the tag, a video keyframe, or
+// any audio tag when there is no video.
+func isSeekPoint(tag Tag, hasvideo bool) bool {
+	if !hasvideo {
+		return tag.Type == TAG_AUDIO
+	}
+	if tag.Type != TAG_VIDEO || tag.FrameType != FRAME_KEY {
+		return false
+	}
+	if tag.IsExHeader {
+		return tag.PacketType == PACKETTYPE_CODED_FRAMES || tag.PacketType == PACKETTYPE_CODED_FRAMESX
+	}
+	return tag.AVCPacketType == AVC_NALU
+}
+
+// readMetaIndex takes the seek points from the keyframes object of
+// onMetaData, the times and filepositions arrays written by most muxers.
+func (self *Demuxer) readMetaIndex(data []byte) {
+	var vals []interface{}
+	for n := 0; n < len(data); {
+		val, size, err := ParseAMF0Val(data[n:])
+		if err != nil {
+			return
+		}
+		n += size
+		vals = append(vals, val)
+	}
+	if len(vals) < 2 || vals[0] != "onMetaData" {
+		return
+	}
+
+	var keyframes AMFMap
+	switch metadata := vals[1].(type) {
+	case AMFMap:
+		keyframes, _ = metadata["keyframes"].(AMFMap)
+	case AMFECMAArray:
+		keyframes, _ = metadata["keyframes"].(AMFMap)
+	}
+	times, _ := keyframes["times"].(AMFArray)
+	positions, _ := keyframes["filepositions"].(AMFArray)
+	if len(times) == 0 || len(times) != len(positions) {
+		return
+	}
+
+	index := make([]seekPoint, 0, len(times))
+	for i := range times {
+		tm, ok1 := times[i].(float64)
+		pos, ok2 := positions[i].(float64)
+		if !ok1 || !ok2 || int64(pos) < self.dataoff {
+			return
+		}
+		point := seekPoint{time: time.Duration(tm * float64(time.Second)), offset: int64(pos)}
+		if n := len(index); n > 0 && (point.time < index[n-1].time || point.offset <= index[n-1].offset) {
+			return
+		}
+		index = append(index, point)
+	}
+	self.index = index
+	self.indexed = true
+	self.metaindex = true
+}
+
+// scanIndex reads the tag headers from the first tag to the end of the file
+// and keeps the seek points, the tag data is skipped.
+func (self *Demuxer) scanIndex() (index []seekPoint, err error) {
+	hasvideo := false
+	for _, stream := range self.prober.Streams {
+		if stream.Type().IsVideo() {
+			hasvideo = true
+		}
+	}
+
+	if err = self.seek(self.dataoff); err != nil {
+		return
+	}
+	index = []seekPoint{}
+	for {
+		off := self.offset()
+		if _, err = io.ReadFull(self.bufr, self.b[:TagHeaderLength]); err != nil {
+			break
+		}
+		var tag Tag
+		var timestamp int32
+		var datalen int
+		if tag, timestamp, datalen, err = ParseTagHeader(self.b); err != nil {
+			return
+		}
+
+		// enough of the data for the frame and packet types
+		peek := datalen
+		if peek > 16 {
+			peek = 16
+		}
+		var hdr []byte
+		if hdr, err = self.bufr.Peek(peek); err != nil {
+			break
+		}
+		if _, err = (&tag).ParseHeader(hdr); err != nil {
+			return
+		}
+		if _, err = self.bufr.Discard(datalen + TagTrailerLength); err != nil {
+			break
+		}
+
+		if isSeekPoint(tag, hasvideo) {
+			index = append(index, seekPoint{time: TsToTime(timestamp), offset: off})
+		}
+	}
+	// a truncated last tag ends the file
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+// SeekToTime moves to the last keyframe at or before tm. The keyframes of
+// onMetaData are used when the file has them, otherwise the tags are scanned
+// once on the first seek. When the seek fails the demuxer stays where it
+// was.
+func (self *Demuxer) SeekToTime(tm time.Duration) (err error) {
+	if err = self.prepare(); err != nil {
+		return
+	}
+
+	off := self.offset()
+	for {
+		if !self.indexed {
+			var index []seekPoint
+			if index, err = self.scanIndex(); err != nil {
+				self.seek(off)
+				return
+			}
+			self.index = index
+			self.indexed = true
+		}
+
+		pos := self.dataoff
+		for _, point := range self.index {
+			if point.time > tm {
+				break
+			}
+			pos = point.offset
+		}
+		if err = self.seek(pos); err != nil {
+			self.seek(off)
+			return
+		}
+
+		// an onMetaData index that misses the tags is dropped for a scan
+		if self.metaindex && !self.atTag() {
+			self.index = nil
+			self.indexed = false
+			self.metaindex = false
+			continue
+		}
+		break
+	}
+
+	self.prober.CachedPkts = nil
+	return
+}
+
+// atTag tells if a valid tag header is at the offset.
+func (self *Demuxer) atTag() bool {
+	b, err := self.bufr.Peek(TagHeaderLength)
+	if err != nil {
+		return false
+	}
+	_, _, _, err = ParseTagHeader(b)
+	return err == nil
+}
+
 func (self *Demuxer) Streams() (streams []av.CodecData, err error) {
 	if err = self.prepare(); err != nil {
 		return
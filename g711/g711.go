@@ -0,0 +1,206 @@
+package g711
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+const (
+	alawSignBit   = 0x80
+	alawQuantMask = 0x0f
+	alawSegMask   = 0x70
+	alawSegShift  = 4
+
+	mulawBias = 0x84
+	mulawClip = 8159
+)
+
+var alawSegEnd = [8]int{0x1f, 0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff}
+var mulawSegEnd = [8]int{0x3f, 0x7f, 0xff, 0x1ff, 0x3ff, 0x7ff, 0xfff, 0x1fff}
+
+func segment(val int, table [8]int) int {
+	for i, end := range table {
+		if val <= end {
+			return i
+		}
+	}
+	return len(table)
+}
+
+// EncodeALaw converts a 16-bit linear sample to A-law, ITU-T G.711.
+func EncodeALaw(sample int16) byte {
+	val := int(sample) >> 3
+
+	var mask int
+	if val >= 0 {
+		mask = 0xd5
+	} else {
+		mask = 0x55
+		val = -val - 1
+	}
+
+	seg := segment(val, alawSegEnd)
+	if seg >= 8 {
+		return byte(0x7f ^ mask)
+	}
+
+	aval := seg << alawSegShift
+	if seg < 2 {
+		aval |= (val >> 1) & alawQuantMask
+	} else {
+		aval |= (val >> uint(seg)) & alawQuantMask
+	}
+	return byte(aval ^ mask)
+}
+
+func DecodeALaw(aval byte) int16 {
+	aval ^= 0x55
+
+	t := int(aval&alawQuantMask) << 4
+	seg := int(aval&alawSegMask) >> alawSegShift
+	switch seg {
+	case 0:
+		t += 8
+	case 1:
+		t += 0x108
+	default:
+		t += 0x108
+		t <<= uint(seg - 1)
+	}
+
+	if aval&alawSignBit != 0 {
+		return int16(t)
+	}
+	return int16(-t)
+}
+
+// EncodeMuLaw converts a 16-bit linear sample to µ-law, ITU-T G.711.
+func EncodeMuLaw(sample int16) byte {
+	val := int(sample) >> 2
+
+	var mask int
+	if val < 0 {
+		val = -val
+		mask = 0x7f
+	} else {
+		mask = 0xff
+	}
+	if val > mulawClip {
+		val = mulawClip
+	}
+	val += mulawBias >> 2
+
+	seg := segment(val, mulawSegEnd)
+	if seg >= 8 {
+		return byte(0x7f ^ mask)
+	}
+
+	uval := seg<<4 | ((val >> uint(seg+1)) & 0xf)
+	return byte(uval ^ mask)
+}
+
+func DecodeMuLaw(uval byte) int16 {
+	uval = ^uval
+
+	t := (int(uval&0x0f) << 3) + mulawBias
+	t <<= uint(uval&0x70) >> 4
+
+	if uval&0x80 != 0 {
+		return int16(mulawBias - t)
+	}
+	return int16(t - mulawBias)
+}
+
+type CodecData struct {
+	typ           av.CodecType
+	sampleRate    int
+	channelLayout av.ChannelLayout
+}
+
+func (self CodecData) Type() av.CodecType {
+	return self.typ
+}
+
+func (self CodecData) SampleRate() int {
+	return self.sampleRate
+}
+
+func (self CodecData) ChannelLayout() av.ChannelLayout {
+	return self.channelLayout
+}
+
+// SampleFormat is the decoded format, G.711 decodes to 16-bit samples.
+func (self CodecData) SampleFormat() av.SampleFormat {
+	return av.S16
+}
+
+func (self CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	if self.sampleRate <= 0 || self.channelLayout.Count() == 0 {
+		err = fmt.Errorf("g711: sample rate or channel layout invalid")
+		return
+	}
+	samples := len(data) / self.channelLayout.Count()
+	dur = time.Duration(samples) * time.Second / time.Duration(self.sampleRate)
+	return
+}
+
+// Decode converts a packet to an interleaved S16 little endian frame.
+func (self CodecData) Decode(data []byte) (frame av.AudioFrame) {
+	decode := DecodeALaw
+	if self.typ == av.PCM_MULAW {
+		decode = DecodeMuLaw
+	}
+
+	b := make([]byte, len(data)*2)
+	for i, c := range data {
+		s := decode(c)
+		b[i*2] = byte(s)
+		b[i*2+1] = byte(s >> 8)
+	}
+
+	frame.SampleFormat = av.S16
+	frame.ChannelLayout = self.channelLayout
+	frame.SampleRate = self.sampleRate
+	if n := self.channelLayout.Count(); n > 0 {
+		frame.SampleCount = len(data) / n
+	}
+	frame.Data = [][]byte{b}
+	return
+}
+
+// Encode converts an interleaved S16 little endian frame to a packet.
+func (self CodecData) Encode(frame av.AudioFrame) (data []byte, err error) {
+	if frame.SampleFormat != av.S16 {
+		err = fmt.Errorf("g711: sample format %v unsupported, want S16", frame.SampleFormat)
+		return
+	}
+
+	encode := EncodeALaw
+	if self.typ == av.PCM_MULAW {
+		encode = EncodeMuLaw
+	}
+
+	b := frame.Data[0]
+	data = make([]byte, len(b)/2)
+	for i := range data {
+		data[i] = encode(int16(uint16(b[i*2]) | uint16(b[i*2+1])<<8))
+	}
+	return
+}
+
+func NewCodecData(typ av.CodecType, samplerate int, layout av.ChannelLayout) (self CodecData, err error) {
+	if typ != av.PCM_ALAW && typ != av.PCM_MULAW {
+		err = fmt.Errorf("g711: codecType=%v invalid", typ)
+		return
+	}
+	if samplerate <= 0 || layout.Count() == 0 {
+		err = fmt.Errorf("g711: samplerate=%d channels=%d invalid", samplerate, layout.Count())
+		return
+	}
+	self.typ = typ
+	self.sampleRate = samplerate
+	self.channelLayout = layout
+	return
+}
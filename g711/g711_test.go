@@ -0,0 +1,125 @@
+package g711
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// values of linear2alaw, alaw2linear, linear2ulaw and ulaw2linear of Sun's
+// g711.c
+func TestALaw(t *testing.T) {
+	encode := []struct {
+		sample int16
+		aval   byte
+	}{
+		{0, 0xd5},
+		{-1, 0x55},
+		{8, 0xd5},
+		{16, 0xd4},
+		{-24, 0x54},
+		{256, 0xc5},
+		{1000, 0xfa},
+		{-1000, 0x7a},
+		{32767, 0xaa},
+		{-32768, 0x2a},
+	}
+	for _, v := range encode {
+		if aval := EncodeALaw(v.sample); aval != v.aval {
+			t.Errorf("EncodeALaw(%d) = %#x, want %#x", v.sample, aval, v.aval)
+		}
+	}
+
+	decode := []struct {
+		aval   byte
+		sample int16
+	}{
+		{0xd5, 8},
+		{0x55, -8},
+		{0xd4, 24},
+		{0xc5, 264},
+		{0xfa, 1008},
+		{0xaa, 32256},
+		{0x2a, -32256},
+	}
+	for _, v := range decode {
+		if sample := DecodeALaw(v.aval); sample != v.sample {
+			t.Errorf("DecodeALaw(%#x) = %d, want %d", v.aval, sample, v.sample)
+		}
+	}
+
+	for i := 0; i < 256; i++ {
+		if aval := EncodeALaw(DecodeALaw(byte(i))); aval != byte(i) {
+			t.Errorf("A-law %#x round trips to %#x", i, aval)
+		}
+	}
+}
+
+func TestMuLaw(t *testing.T) {
+	encode := []struct {
+		sample int16
+		uval   byte
+	}{
+		{0, 0xff},
+		{-1, 0x7e},
+		{8, 0xfe},
+		{-8, 0x7e},
+		{1000, 0xce},
+		{-1000, 0x4e},
+		{32767, 0x80},
+		{-32768, 0x00},
+	}
+	for _, v := range encode {
+		if uval := EncodeMuLaw(v.sample); uval != v.uval {
+			t.Errorf("EncodeMuLaw(%d) = %#x, want %#x", v.sample, uval, v.uval)
+		}
+	}
+
+	decode := []struct {
+		uval   byte
+		sample int16
+	}{
+		{0xff, 0},
+		{0x7f, 0},
+		{0xfe, 8},
+		{0xce, 988},
+		{0x80, 32124},
+		{0x00, -32124},
+	}
+	for _, v := range decode {
+		if sample := DecodeMuLaw(v.uval); sample != v.sample {
+			t.Errorf("DecodeMuLaw(%#x) = %d, want %d", v.uval, sample, v.sample)
+		}
+	}
+
+	// 0x7f is the negative zero, it encodes back as 0xff
+	for i := 0; i < 256; i++ {
+		if i == 0x7f {
+			continue
+		}
+		if uval := EncodeMuLaw(DecodeMuLaw(byte(i))); uval != byte(i) {
+			t.Errorf("mu-law %#x round trips to %#x", i, uval)
+		}
+	}
+}
+
+func TestCodecData(t *testing.T) {
+	codec, err := NewCodecData(av.PCM_MULAW, 8000, av.CH_STEREO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dur, err := codec.PacketDuration(make([]byte, 320)); err != nil || dur != 20*time.Millisecond {
+		t.Errorf("PacketDuration = %v %v, want 20ms", dur, err)
+	}
+
+	if _, err := NewCodecData(av.PCM_ALAW, 0, av.CH_MONO); err == nil {
+		t.Errorf("samplerate 0 accepted")
+	}
+	if _, err := NewCodecData(av.PCM_ALAW, 8000, 0); err == nil {
+		t.Errorf("no channels accepted")
+	}
+	if _, err := (CodecData{}).PacketDuration(make([]byte, 160)); err == nil {
+		t.Errorf("PacketDuration of a zero CodecData succeeded")
+	}
+}
@@ -0,0 +1,1006 @@
+package h265
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/bits"
+	"github.com/notedit/rtmp-lib/pio"
+)
+
+const (
+	NALU_BLA_W_LP   = 16
+	NALU_BLA_W_RADL = 17
+	NALU_BLA_N_LP   = 18
+	NALU_IDR_W_RADL = 19
+	NALU_IDR_N_LP   = 20
+	NALU_CRA        = 21
+	NALU_VPS        = 32
+	NALU_SPS        = 33
+	NALU_PPS        = 34
+	NALU_AUD        = 35
+	NALU_EOS        = 36
+	NALU_EOB        = 37
+	NALU_FD         = 38
+	NALU_SEI_PREFIX = 39
+	NALU_SEI_SUFFIX = 40
+)
+
+const (
+	NALU_RAW = iota
+	NALU_AVCC
+	NALU_ANNEXB
+)
+
+// NALUType returns nal_unit_type from the 2-byte HEVC NAL unit header.
+func NALUType(b []byte) uint8 {
+	return (b[0] >> 1) & 0x3f
+}
+
+func isValidNALU(b []byte) bool {
+	// forbidden_zero_bit, nuh_temporal_id_plus1 must not be 0
+	return len(b) >= 2 && b[0]&0x80 == 0 && b[1]&0x7 != 0
+}
+
+func SplitNALUs(b []byte) (nalus [][]byte, typ int) {
+	if len(b) < 4 {
+		return [][]byte{b}, NALU_RAW
+	}
+
+	val3 := pio.U24BE(b)
+	val4 := pio.U32BE(b)
+
+	// maybe AVCC
+	if val4 <= uint32(len(b)) {
+		_b := b
+		avcc := [][]byte{}
+		for len(_b) >= 4 {
+			_val4 := pio.U32BE(_b)
+			_b = _b[4:]
+			if _val4 > uint32(len(_b)) || !isValidNALU(_b[:_val4]) {
+				break
+			}
+			avcc = append(avcc, _b[:_val4])
+			_b = _b[_val4:]
+		}
+		if len(_b) == 0 && len(avcc) > 0 {
+			return avcc, NALU_AVCC
+		}
+	}
+
+	// is Annex B
+	if val3 == 1 || val4 == 1 {
+		start := -1
+		for pos := 0; pos+2 < len(b); {
+			if b[pos] == 0 && b[pos+1] == 0 && b[pos+2] == 1 {
+				if start != -1 {
+					nalus = appendAnnexBNALU(nalus, b[start:pos])
+				}
+				pos += 3
+				start = pos
+			} else {
+				pos++
+			}
+		}
+		if start != -1 {
+			nalus = appendAnnexBNALU(nalus, b[start:])
+		}
+		typ = NALU_ANNEXB
+		return
+	}
+
+	return [][]byte{b}, NALU_RAW
+}
+
+func appendAnnexBNALU(nalus [][]byte, b []byte) [][]byte {
+	// trailing_zero_8bits, and the leading zero of a 4-byte start code
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	if len(b) < 2 {
+		return nalus
+	}
+	return append(nalus, b)
+}
+
+// IsIRAP reports whether the nal unit type is a random access point
+// (BLA, IDR, CRA or reserved IRAP).
+func IsIRAP(typ uint8) bool {
+	return typ >= NALU_BLA_W_LP && typ <= 23
+}
+
+func IsDataNALU(b []byte) bool {
+	return NALUType(b) < NALU_VPS
+}
+
+// IsKeyFrame reports whether a packet, in AVCC or Annex B, carries an IRAP
+// picture.
+func IsKeyFrame(b []byte) bool {
+	nalus, _ := SplitNALUs(b)
+	for _, nalu := range nalus {
+		if len(nalu) >= 2 && IsIRAP(NALUType(nalu)) {
+			return true
+		}
+	}
+	return false
+}
+
+// unescapeRBSP removes emulation_prevention_three_byte.
+func unescapeRBSP(b []byte) []byte {
+	out := make([]byte, 0, len(b))
+	zeros := 0
+	for _, c := range b {
+		if zeros >= 2 && c == 3 {
+			zeros = 0
+			continue
+		}
+		if c == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+type ProfileTierLevel struct {
+	GeneralProfileSpace              uint
+	GeneralTierFlag                  uint
+	GeneralProfileIdc                uint
+	GeneralProfileCompatibilityFlags uint32
+	GeneralConstraintIndicatorFlags  uint64
+	GeneralLevelIdc                  uint
+}
+
+func parseProfileTierLevel(r *bits.GolombBitReader, maxSubLayersMinus1 uint) (self ProfileTierLevel, err error) {
+	if self.GeneralProfileSpace, err = r.ReadBits(2); err != nil {
+		return
+	}
+	if self.GeneralTierFlag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if self.GeneralProfileIdc, err = r.ReadBits(5); err != nil {
+		return
+	}
+
+	var v uint
+	if v, err = r.ReadBits(32); err != nil {
+		return
+	}
+	self.GeneralProfileCompatibilityFlags = uint32(v)
+
+	// progressive_source_flag, interlaced_source_flag,
+	// non_packed_constraint_flag, frame_only_constraint_flag,
+	// 43 reserved bits, inbld_flag
+	var hi, lo uint
+	if hi, err = r.ReadBits(16); err != nil {
+		return
+	}
+	if lo, err = r.ReadBits(32); err != nil {
+		return
+	}
+	self.GeneralConstraintIndicatorFlags = uint64(hi)<<32 | uint64(lo)
+
+	if self.GeneralLevelIdc, err = r.ReadBits(8); err != nil {
+		return
+	}
+
+	var profilePresent, levelPresent [8]uint
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+		if levelPresent[i], err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	if maxSubLayersMinus1 > 0 {
+		for i := maxSubLayersMinus1; i < 8; i++ {
+			// reserved_zero_2bits
+			if _, err = r.ReadBits(2); err != nil {
+				return
+			}
+		}
+	}
+	for i := uint(0); i < maxSubLayersMinus1; i++ {
+		if profilePresent[i] != 0 {
+			// sub_layer profile_space .. inbld_flag, 88 bits
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+			if _, err = r.ReadBits(24); err != nil {
+				return
+			}
+		}
+		if levelPresent[i] != 0 {
+			if _, err = r.ReadBits(8); err != nil {
+				return
+			}
+		}
+	}
+
+	return
+}
+
+type VPSInfo struct {
+	VpsId              uint
+	MaxSubLayersMinus1 uint
+	TemporalIdNesting  uint
+	ProfileTierLevel   ProfileTierLevel
+
+	NumUnitsInTick uint
+	TimeScale      uint
+}
+
+func ParseVPS(data []byte) (self VPSInfo, err error) {
+	r := &bits.GolombBitReader{R: bytes.NewReader(unescapeRBSP(data))}
+
+	// nal_unit_header
+	if _, err = r.ReadBits(16); err != nil {
+		return
+	}
+
+	if self.VpsId, err = r.ReadBits(4); err != nil {
+		return
+	}
+	// vps_base_layer_internal_flag, vps_base_layer_available_flag, vps_max_layers_minus1
+	if _, err = r.ReadBits(8); err != nil {
+		return
+	}
+	if self.MaxSubLayersMinus1, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if self.TemporalIdNesting, err = r.ReadBit(); err != nil {
+		return
+	}
+	// vps_reserved_0xffff_16bits
+	if _, err = r.ReadBits(16); err != nil {
+		return
+	}
+
+	if self.ProfileTierLevel, err = parseProfileTierLevel(r, self.MaxSubLayersMinus1); err != nil {
+		return
+	}
+
+	var sub_layer_ordering_info_present_flag uint
+	if sub_layer_ordering_info_present_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	i := self.MaxSubLayersMinus1
+	if sub_layer_ordering_info_present_flag != 0 {
+		i = 0
+	}
+	for ; i <= self.MaxSubLayersMinus1; i++ {
+		// max_dec_pic_buffering_minus1, max_num_reorder_pics, max_latency_increase_plus1
+		for j := 0; j < 3; j++ {
+			if _, err = r.ReadExponentialGolombCode(); err != nil {
+				return
+			}
+		}
+	}
+
+	var vps_max_layer_id, vps_num_layer_sets_minus1 uint
+	if vps_max_layer_id, err = r.ReadBits(6); err != nil {
+		return
+	}
+	if vps_num_layer_sets_minus1, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	for i := uint(1); i <= vps_num_layer_sets_minus1; i++ {
+		// layer_id_included_flag
+		if _, err = r.ReadBits(int(vps_max_layer_id) + 1); err != nil {
+			return
+		}
+	}
+
+	var vps_timing_info_present_flag uint
+	if vps_timing_info_present_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if vps_timing_info_present_flag != 0 {
+		if self.NumUnitsInTick, err = r.ReadBits(32); err != nil {
+			return
+		}
+		if self.TimeScale, err = r.ReadBits(32); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+type SPSInfo struct {
+	VpsId              uint
+	MaxSubLayersMinus1 uint
+	TemporalIdNesting  uint
+	ProfileTierLevel   ProfileTierLevel
+	SpsId              uint
+
+	ChromaFormatIdc         uint
+	SeparateColourPlaneFlag uint
+	BitDepthLuma            uint
+	BitDepthChroma          uint
+
+	PicWidthInLumaSamples  uint
+	PicHeightInLumaSamples uint
+
+	ConfWinLeftOffset   uint
+	ConfWinRightOffset  uint
+	ConfWinTopOffset    uint
+	ConfWinBottomOffset uint
+
+	NumUnitsInTick uint
+	TimeScale      uint
+
+	Width  uint
+	Height uint
+}
+
+// FrameRate is 0 if the VUI has no timing info.
+func (self SPSInfo) FrameRate() float64 {
+	if self.NumUnitsInTick == 0 {
+		return 0
+	}
+	return float64(self.TimeScale) / float64(self.NumUnitsInTick)
+}
+
+func skipScalingListData(r *bits.GolombBitReader) (err error) {
+	for sizeId := 0; sizeId < 4; sizeId++ {
+		step := 1
+		if sizeId == 3 {
+			step = 3
+		}
+		for matrixId := 0; matrixId < 6; matrixId += step {
+			var scaling_list_pred_mode_flag uint
+			if scaling_list_pred_mode_flag, err = r.ReadBit(); err != nil {
+				return
+			}
+			if scaling_list_pred_mode_flag == 0 {
+				// scaling_list_pred_matrix_id_delta
+				if _, err = r.ReadExponentialGolombCode(); err != nil {
+					return
+				}
+				continue
+			}
+			coefNum := 1 << uint(4+(sizeId<<1))
+			if coefNum > 64 {
+				coefNum = 64
+			}
+			if sizeId > 1 {
+				// scaling_list_dc_coef_minus8
+				if _, err = r.ReadSE(); err != nil {
+					return
+				}
+			}
+			for i := 0; i < coefNum; i++ {
+				// scaling_list_delta_coef
+				if _, err = r.ReadSE(); err != nil {
+					return
+				}
+			}
+		}
+	}
+	return
+}
+
+// skipShortTermRefPicSet reads st_ref_pic_set(idx) and records its
+// NumDeltaPocs, later sets may be predicted from earlier ones.
+func skipShortTermRefPicSet(r *bits.GolombBitReader, idx int, numDeltaPocs []uint) (err error) {
+	var inter_ref_pic_set_prediction_flag uint
+	if idx != 0 {
+		if inter_ref_pic_set_prediction_flag, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	if inter_ref_pic_set_prediction_flag != 0 {
+		// delta_rps_sign
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+		// abs_delta_rps_minus1
+		if _, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		refIdx := idx - 1
+		n := uint(0)
+		for j := uint(0); j <= numDeltaPocs[refIdx]; j++ {
+			var used_by_curr_pic_flag uint
+			use_delta_flag := uint(1)
+			if used_by_curr_pic_flag, err = r.ReadBit(); err != nil {
+				return
+			}
+			if used_by_curr_pic_flag == 0 {
+				if use_delta_flag, err = r.ReadBit(); err != nil {
+					return
+				}
+			}
+			if used_by_curr_pic_flag != 0 || use_delta_flag != 0 {
+				n++
+			}
+		}
+		numDeltaPocs[idx] = n
+		return
+	}
+
+	var num_negative_pics, num_positive_pics uint
+	if num_negative_pics, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if num_positive_pics, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if num_negative_pics+num_positive_pics > 32 {
+		err = fmt.Errorf("h265parser: st_ref_pic_set invalid")
+		return
+	}
+	for i := uint(0); i < num_negative_pics+num_positive_pics; i++ {
+		// delta_poc_minus1
+		if _, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		// used_by_curr_pic_flag
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+	numDeltaPocs[idx] = num_negative_pics + num_positive_pics
+	return
+}
+
+func ParseSPS(data []byte) (self SPSInfo, err error) {
+	r := &bits.GolombBitReader{R: bytes.NewReader(unescapeRBSP(data))}
+
+	// nal_unit_header
+	if _, err = r.ReadBits(16); err != nil {
+		return
+	}
+
+	if self.VpsId, err = r.ReadBits(4); err != nil {
+		return
+	}
+	if self.MaxSubLayersMinus1, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if self.TemporalIdNesting, err = r.ReadBit(); err != nil {
+		return
+	}
+
+	if self.ProfileTierLevel, err = parseProfileTierLevel(r, self.MaxSubLayersMinus1); err != nil {
+		return
+	}
+
+	if self.SpsId, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+
+	if self.ChromaFormatIdc, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.ChromaFormatIdc == 3 {
+		if self.SeparateColourPlaneFlag, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	if self.PicWidthInLumaSamples, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if self.PicHeightInLumaSamples, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+
+	var conformance_window_flag uint
+	if conformance_window_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if conformance_window_flag != 0 {
+		if self.ConfWinLeftOffset, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if self.ConfWinRightOffset, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if self.ConfWinTopOffset, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		if self.ConfWinBottomOffset, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+	}
+
+	subWidthC, subHeightC := uint(1), uint(1)
+	if self.SeparateColourPlaneFlag == 0 {
+		switch self.ChromaFormatIdc {
+		case 1:
+			subWidthC, subHeightC = 2, 2
+		case 2:
+			subWidthC = 2
+		}
+	}
+	cropw := subWidthC * (self.ConfWinLeftOffset + self.ConfWinRightOffset)
+	croph := subHeightC * (self.ConfWinTopOffset + self.ConfWinBottomOffset)
+	if cropw >= self.PicWidthInLumaSamples || croph >= self.PicHeightInLumaSamples {
+		err = fmt.Errorf("h265parser: SPS conformance window invalid")
+		return
+	}
+	self.Width = self.PicWidthInLumaSamples - cropw
+	self.Height = self.PicHeightInLumaSamples - croph
+
+	var v uint
+	if v, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	self.BitDepthLuma = v + 8
+	if v, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	self.BitDepthChroma = v + 8
+
+	// the rest is only needed for the VUI frame rate, a broken tail
+	// still leaves a usable SPSInfo
+	self.parseTail(r)
+	return
+}
+
+func (self *SPSInfo) parseTail(r *bits.GolombBitReader) (err error) {
+	var log2_max_pic_order_cnt_lsb_minus4 uint
+	if log2_max_pic_order_cnt_lsb_minus4, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+
+	var sub_layer_ordering_info_present_flag uint
+	if sub_layer_ordering_info_present_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	i := self.MaxSubLayersMinus1
+	if sub_layer_ordering_info_present_flag != 0 {
+		i = 0
+	}
+	for ; i <= self.MaxSubLayersMinus1; i++ {
+		// max_dec_pic_buffering_minus1, max_num_reorder_pics, max_latency_increase_plus1
+		for j := 0; j < 3; j++ {
+			if _, err = r.ReadExponentialGolombCode(); err != nil {
+				return
+			}
+		}
+	}
+
+	// log2_min_luma_coding_block_size_minus3 .. max_transform_hierarchy_depth_intra
+	for j := 0; j < 6; j++ {
+		if _, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+	}
+
+	var scaling_list_enabled_flag uint
+	if scaling_list_enabled_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if scaling_list_enabled_flag != 0 {
+		var sps_scaling_list_data_present_flag uint
+		if sps_scaling_list_data_present_flag, err = r.ReadBit(); err != nil {
+			return
+		}
+		if sps_scaling_list_data_present_flag != 0 {
+			if err = skipScalingListData(r); err != nil {
+				return
+			}
+		}
+	}
+
+	// amp_enabled_flag, sample_adaptive_offset_enabled_flag
+	if _, err = r.ReadBits(2); err != nil {
+		return
+	}
+
+	var pcm_enabled_flag uint
+	if pcm_enabled_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if pcm_enabled_flag != 0 {
+		// pcm_sample_bit_depth_luma_minus1, pcm_sample_bit_depth_chroma_minus1
+		if _, err = r.ReadBits(8); err != nil {
+			return
+		}
+		// log2_min_pcm_luma_coding_block_size_minus3, log2_diff_max_min_pcm_luma_coding_block_size
+		for j := 0; j < 2; j++ {
+			if _, err = r.ReadExponentialGolombCode(); err != nil {
+				return
+			}
+		}
+		// pcm_loop_filter_disabled_flag
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	var num_short_term_ref_pic_sets uint
+	if num_short_term_ref_pic_sets, err = r.ReadExponentialGolombCode(); err != nil {
+		return
+	}
+	if num_short_term_ref_pic_sets > 64 {
+		err = fmt.Errorf("h265parser: num_short_term_ref_pic_sets invalid")
+		return
+	}
+	numDeltaPocs := make([]uint, num_short_term_ref_pic_sets)
+	for j := 0; j < int(num_short_term_ref_pic_sets); j++ {
+		if err = skipShortTermRefPicSet(r, j, numDeltaPocs); err != nil {
+			return
+		}
+	}
+
+	var long_term_ref_pics_present_flag uint
+	if long_term_ref_pics_present_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if long_term_ref_pics_present_flag != 0 {
+		var num_long_term_ref_pics_sps uint
+		if num_long_term_ref_pics_sps, err = r.ReadExponentialGolombCode(); err != nil {
+			return
+		}
+		for j := uint(0); j < num_long_term_ref_pics_sps; j++ {
+			// lt_ref_pic_poc_lsb_sps, used_by_curr_pic_lt_sps_flag
+			if _, err = r.ReadBits(int(log2_max_pic_order_cnt_lsb_minus4) + 4 + 1); err != nil {
+				return
+			}
+		}
+	}
+
+	// sps_temporal_mvp_enabled_flag, strong_intra_smoothing_enabled_flag
+	if _, err = r.ReadBits(2); err != nil {
+		return
+	}
+
+	var vui_parameters_present_flag uint
+	if vui_parameters_present_flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if vui_parameters_present_flag != 0 {
+		if err = self.parseVUI(r); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+func (self *SPSInfo) parseVUI(r *bits.GolombBitReader) (err error) {
+	var flag uint
+
+	// aspect_ratio_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		var aspect_ratio_idc uint
+		if aspect_ratio_idc, err = r.ReadBits(8); err != nil {
+			return
+		}
+		if aspect_ratio_idc == 255 {
+			// sar_width, sar_height
+			if _, err = r.ReadBits(32); err != nil {
+				return
+			}
+		}
+	}
+
+	// overscan_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		// overscan_appropriate_flag
+		if _, err = r.ReadBit(); err != nil {
+			return
+		}
+	}
+
+	// video_signal_type_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		// video_format, video_full_range_flag
+		if _, err = r.ReadBits(4); err != nil {
+			return
+		}
+		// colour_description_present_flag
+		if flag, err = r.ReadBit(); err != nil {
+			return
+		}
+		if flag != 0 {
+			// colour_primaries, transfer_characteristics, matrix_coeffs
+			if _, err = r.ReadBits(24); err != nil {
+				return
+			}
+		}
+	}
+
+	// chroma_loc_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		for j := 0; j < 2; j++ {
+			if _, err = r.ReadExponentialGolombCode(); err != nil {
+				return
+			}
+		}
+	}
+
+	// neutral_chroma_indication_flag, field_seq_flag, frame_field_info_present_flag
+	if _, err = r.ReadBits(3); err != nil {
+		return
+	}
+
+	// default_display_window_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		for j := 0; j < 4; j++ {
+			if _, err = r.ReadExponentialGolombCode(); err != nil {
+				return
+			}
+		}
+	}
+
+	// vui_timing_info_present_flag
+	if flag, err = r.ReadBit(); err != nil {
+		return
+	}
+	if flag != 0 {
+		if self.NumUnitsInTick, err = r.ReadBits(32); err != nil {
+			return
+		}
+		if self.TimeScale, err = r.ReadBits(32); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo HEVCDecoderConfRecord
+	SPSInfo    SPSInfo
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.H265
+}
+
+func (self CodecData) HEVCDecoderConfRecordBytes() []byte {
+	return self.Record
+}
+
+func (self CodecData) VPS() []byte {
+	return self.RecordInfo.VPS[0]
+}
+
+func (self CodecData) SPS() []byte {
+	return self.RecordInfo.SPS[0]
+}
+
+func (self CodecData) PPS() []byte {
+	return self.RecordInfo.PPS[0]
+}
+
+func (self CodecData) Width() int {
+	return int(self.SPSInfo.Width)
+}
+
+func (self CodecData) Height() int {
+	return int(self.SPSInfo.Height)
+}
+
+func (self CodecData) FrameRate() float64 {
+	return self.SPSInfo.FrameRate()
+}
+
+func NewCodecDataFromHEVCDecoderConfRecord(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+	if len(self.RecordInfo.VPS) == 0 {
+		err = fmt.Errorf("h265parser: no VPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if len(self.RecordInfo.SPS) == 0 {
+		err = fmt.Errorf("h265parser: no SPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if len(self.RecordInfo.PPS) == 0 {
+		err = fmt.Errorf("h265parser: no PPS found in HEVCDecoderConfRecord")
+		return
+	}
+	if self.SPSInfo, err = ParseSPS(self.RecordInfo.SPS[0]); err != nil {
+		err = fmt.Errorf("h265parser: parse SPS failed(%s)", err)
+		return
+	}
+	return
+}
+
+func NewCodecDataFromVPSAndSPSAndPPS(vps, sps, pps []byte) (self CodecData, err error) {
+	if self.SPSInfo, err = ParseSPS(sps); err != nil {
+		return
+	}
+
+	ptl := self.SPSInfo.ProfileTierLevel
+	recordinfo := HEVCDecoderConfRecord{}
+	recordinfo.GeneralProfileSpace = uint8(ptl.GeneralProfileSpace)
+	recordinfo.GeneralTierFlag = uint8(ptl.GeneralTierFlag)
+	recordinfo.GeneralProfileIdc = uint8(ptl.GeneralProfileIdc)
+	recordinfo.GeneralProfileCompatibilityFlags = ptl.GeneralProfileCompatibilityFlags
+	recordinfo.GeneralConstraintIndicatorFlags = ptl.GeneralConstraintIndicatorFlags
+	recordinfo.GeneralLevelIdc = uint8(ptl.GeneralLevelIdc)
+	recordinfo.ChromaFormat = uint8(self.SPSInfo.ChromaFormatIdc)
+	recordinfo.BitDepthLumaMinus8 = uint8(self.SPSInfo.BitDepthLuma - 8)
+	recordinfo.BitDepthChromaMinus8 = uint8(self.SPSInfo.BitDepthChroma - 8)
+	recordinfo.NumTemporalLayers = uint8(self.SPSInfo.MaxSubLayersMinus1 + 1)
+	recordinfo.TemporalIdNested = uint8(self.SPSInfo.TemporalIdNesting)
+	recordinfo.LengthSizeMinusOne = 3
+	recordinfo.VPS = [][]byte{vps}
+	recordinfo.SPS = [][]byte{sps}
+	recordinfo.PPS = [][]byte{pps}
+
+	buf := make([]byte, recordinfo.Len())
+	recordinfo.Marshal(buf)
+
+	self.RecordInfo = recordinfo
+	self.Record = buf
+	return
+}
+
+type HEVCDecoderConfRecord struct {
+	GeneralProfileSpace              uint8
+	GeneralTierFlag                  uint8
+	GeneralProfileIdc                uint8
+	GeneralProfileCompatibilityFlags uint32
+	GeneralConstraintIndicatorFlags  uint64
+	GeneralLevelIdc                  uint8
+	MinSpatialSegmentationIdc        uint16
+	ParallelismType                  uint8
+	ChromaFormat                     uint8
+	BitDepthLumaMinus8               uint8
+	BitDepthChromaMinus8             uint8
+	AvgFrameRate                     uint16
+	ConstantFrameRate                uint8
+	NumTemporalLayers                uint8
+	TemporalIdNested                 uint8
+	LengthSizeMinusOne               uint8
+	VPS                              [][]byte
+	SPS                              [][]byte
+	PPS                              [][]byte
+}
+
+var ErrDecconfInvalid = fmt.Errorf("h265parser: HEVCDecoderConfRecord invalid")
+
+func (self *HEVCDecoderConfRecord) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 23 {
+		err = ErrDecconfInvalid
+		return
+	}
+
+	self.GeneralProfileSpace = b[1] >> 6
+	self.GeneralTierFlag = (b[1] >> 5) & 0x1
+	self.GeneralProfileIdc = b[1] & 0x1f
+	self.GeneralProfileCompatibilityFlags = pio.U32BE(b[2:])
+	self.GeneralConstraintIndicatorFlags = pio.U64BE(b[6:]) >> 16
+	self.GeneralLevelIdc = b[12]
+	self.MinSpatialSegmentationIdc = pio.U16BE(b[13:]) & 0x0fff
+	self.ParallelismType = b[15] & 0x3
+	self.ChromaFormat = b[16] & 0x3
+	self.BitDepthLumaMinus8 = b[17] & 0x7
+	self.BitDepthChromaMinus8 = b[18] & 0x7
+	self.AvgFrameRate = pio.U16BE(b[19:])
+	self.ConstantFrameRate = b[21] >> 6
+	self.NumTemporalLayers = (b[21] >> 3) & 0x7
+	self.TemporalIdNested = (b[21] >> 2) & 0x1
+	self.LengthSizeMinusOne = b[21] & 0x3
+	numarrays := int(b[22])
+	n += 23
+
+	for i := 0; i < numarrays; i++ {
+		if len(b) < n+3 {
+			err = ErrDecconfInvalid
+			return
+		}
+		naltype := b[n] & 0x3f
+		numnalus := int(pio.U16BE(b[n+1:]))
+		n += 3
+
+		for j := 0; j < numnalus; j++ {
+			if len(b) < n+2 {
+				err = ErrDecconfInvalid
+				return
+			}
+			nalulen := int(pio.U16BE(b[n:]))
+			n += 2
+
+			if len(b) < n+nalulen {
+				err = ErrDecconfInvalid
+				return
+			}
+			nalu := b[n : n+nalulen]
+			n += nalulen
+
+			switch naltype {
+			case NALU_VPS:
+				self.VPS = append(self.VPS, nalu)
+			case NALU_SPS:
+				self.SPS = append(self.SPS, nalu)
+			case NALU_PPS:
+				self.PPS = append(self.PPS, nalu)
+			}
+		}
+	}
+
+	return
+}
+
+func (self HEVCDecoderConfRecord) arrays() (arrays [][][]byte, types []uint8) {
+	for i, nalus := range [][][]byte{self.VPS, self.SPS, self.PPS} {
+		if len(nalus) > 0 {
+			arrays = append(arrays, nalus)
+			types = append(types, uint8(NALU_VPS+i))
+		}
+	}
+	return
+}
+
+func (self HEVCDecoderConfRecord) Len() (n int) {
+	n = 23
+	arrays, _ := self.arrays()
+	for _, nalus := range arrays {
+		n += 3
+		for _, nalu := range nalus {
+			n += 2 + len(nalu)
+		}
+	}
+	return
+}
+
+func (self HEVCDecoderConfRecord) Marshal(b []byte) (n int) {
+	b[0] = 1
+	b[1] = self.GeneralProfileSpace<<6 | (self.GeneralTierFlag&0x1)<<5 | self.GeneralProfileIdc&0x1f
+	pio.PutU32BE(b[2:], self.GeneralProfileCompatibilityFlags)
+	pio.PutU32BE(b[6:], uint32(self.GeneralConstraintIndicatorFlags>>16))
+	pio.PutU16BE(b[10:], uint16(self.GeneralConstraintIndicatorFlags))
+	b[12] = self.GeneralLevelIdc
+	pio.PutU16BE(b[13:], 0xf000|self.MinSpatialSegmentationIdc)
+	b[15] = 0xfc | self.ParallelismType
+	b[16] = 0xfc | self.ChromaFormat
+	b[17] = 0xf8 | self.BitDepthLumaMinus8
+	b[18] = 0xf8 | self.BitDepthChromaMinus8
+	pio.PutU16BE(b[19:], self.AvgFrameRate)
+	b[21] = self.ConstantFrameRate<<6 | (self.NumTemporalLayers&0x7)<<3 |
+		(self.TemporalIdNested&0x1)<<2 | self.LengthSizeMinusOne&0x3
+
+	arrays, types := self.arrays()
+	b[22] = uint8(len(arrays))
+	n += 23
+
+	for i, nalus := range arrays {
+		// array_completeness
+		b[n] = 0x80 | types[i]
+		pio.PutU16BE(b[n+1:], uint16(len(nalus)))
+		n += 3
+		for _, nalu := range nalus {
+			pio.PutU16BE(b[n:], uint16(len(nalu)))
+			n += 2
+			copy(b[n:], nalu)
+			n += len(nalu)
+		}
+	}
+
+	return
+}
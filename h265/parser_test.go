@@ -0,0 +1,212 @@
+package h265
+
+import (
+	"bytes"
+	"testing"
+)
+
+// parameter sets of a 1280x720 29.97fps Main profile stream from x265
+var (
+	testVPS = []byte{
+		0x40, 0x01, 0x0c, 0x01, 0xff, 0xff, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00,
+		0x90, 0x00, 0x00, 0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0x95, 0x98, 0x09,
+	}
+	testSPS = []byte{
+		0x42, 0x01, 0x01, 0x01, 0x60, 0x00, 0x00, 0x03, 0x00, 0x90, 0x00, 0x00,
+		0x03, 0x00, 0x00, 0x03, 0x00, 0x5d, 0xa0, 0x02, 0x80, 0x80, 0x2d, 0x16,
+		0x59, 0x59, 0xa4, 0x93, 0x2b, 0xc0, 0x5a, 0x70, 0x80, 0x00, 0x01, 0xf4,
+		0x80, 0x00, 0x3a, 0x98, 0x04,
+	}
+	testPPS = []byte{0x44, 0x01, 0xc1, 0x72, 0xb4, 0x62, 0x40}
+)
+
+// testRecord is the hvcC of the parameter sets above.
+func testRecord() []byte {
+	b := []byte{
+		0x01,
+		// profile space 0, tier 0, Main
+		0x01,
+		0x60, 0x00, 0x00, 0x00,
+		0x90, 0x00, 0x00, 0x00, 0x00, 0x00,
+		// level 3.1
+		0x5d,
+		0xf0, 0x00,
+		0xfc,
+		// 4:2:0, 8 bit
+		0xfd, 0xf8, 0xf8,
+		0x00, 0x00,
+		// 1 temporal layer, nested, 4 byte lengths
+		0x0f,
+		0x03,
+	}
+	for _, array := range []struct {
+		typ  byte
+		nalu []byte
+	}{{0xa0, testVPS}, {0xa1, testSPS}, {0xa2, testPPS}} {
+		b = append(b, array.typ, 0x00, 0x01, 0x00, byte(len(array.nalu)))
+		b = append(b, array.nalu...)
+	}
+	return b
+}
+
+func TestParseSPS(t *testing.T) {
+	sps, err := ParseSPS(testSPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Width != 1280 || sps.Height != 720 {
+		t.Errorf("size %dx%d, want 1280x720", sps.Width, sps.Height)
+	}
+	ptl := sps.ProfileTierLevel
+	if ptl.GeneralProfileIdc != 1 || ptl.GeneralLevelIdc != 93 || ptl.GeneralTierFlag != 0 {
+		t.Errorf("profile %d level %d tier %d, want 1 93 0", ptl.GeneralProfileIdc, ptl.GeneralLevelIdc, ptl.GeneralTierFlag)
+	}
+	if sps.ChromaFormatIdc != 1 || sps.BitDepthLuma != 8 || sps.BitDepthChroma != 8 {
+		t.Errorf("chroma format %d bit depth %d/%d, want 1 8/8", sps.ChromaFormatIdc, sps.BitDepthLuma, sps.BitDepthChroma)
+	}
+	if sps.NumUnitsInTick != 1001 || sps.TimeScale != 30000 {
+		t.Errorf("timing %d/%d, want 1001/30000", sps.NumUnitsInTick, sps.TimeScale)
+	}
+
+	vps, err := ParseVPS(testVPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vps.ProfileTierLevel.GeneralLevelIdc != 93 {
+		t.Errorf("vps level %d, want 93", vps.ProfileTierLevel.GeneralLevelIdc)
+	}
+}
+
+// bitWriter builds the SPS of the conformance window tests.
+type bitWriter struct {
+	b    []byte
+	nbit uint
+}
+
+func (self *bitWriter) writeBits(val uint64, n uint) {
+	for i := n; i > 0; i-- {
+		if self.nbit%8 == 0 {
+			self.b = append(self.b, 0)
+		}
+		if val>>(i-1)&1 != 0 {
+			self.b[len(self.b)-1] |= 0x80 >> (self.nbit % 8)
+		}
+		self.nbit++
+	}
+}
+
+func (self *bitWriter) writeUE(val uint64) {
+	n := uint(0)
+	for (val+1)>>n > 1 {
+		n++
+	}
+	self.writeBits(0, n)
+	self.writeBits(val+1, n+1)
+}
+
+func makeSPS(width, height, left, right, top, bottom uint64) []byte {
+	w := &bitWriter{b: []byte{0x42, 0x01}, nbit: 16}
+	// vps id, max sub layers minus 1, temporal id nesting
+	w.writeBits(0, 4)
+	w.writeBits(0, 3)
+	w.writeBits(1, 1)
+	// profile_tier_level: Main, level 4
+	w.writeBits(1, 8)
+	w.writeBits(0x60000000, 32)
+	w.writeBits(0x900000000000, 48)
+	w.writeBits(120, 8)
+	// sps id, chroma format 4:2:0
+	w.writeUE(0)
+	w.writeUE(1)
+	w.writeUE(width)
+	w.writeUE(height)
+	w.writeBits(1, 1)
+	w.writeUE(left)
+	w.writeUE(right)
+	w.writeUE(top)
+	w.writeUE(bottom)
+	// bit depths
+	w.writeUE(0)
+	w.writeUE(0)
+	w.writeBits(1, 1)
+	return w.b
+}
+
+func TestParseSPSConformanceWindow(t *testing.T) {
+	sps, err := ParseSPS(makeSPS(1920, 1088, 0, 0, 0, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sps.Width != 1920 || sps.Height != 1080 {
+		t.Errorf("size %dx%d, want 1920x1080", sps.Width, sps.Height)
+	}
+
+	for _, b := range [][]byte{
+		makeSPS(64, 64, 20, 12, 0, 0),
+		makeSPS(64, 64, 0, 0, 0, 40),
+	} {
+		if sps, err := ParseSPS(b); err == nil {
+			t.Errorf("window larger than the picture accepted, size %dx%d", sps.Width, sps.Height)
+		}
+	}
+}
+
+func TestHEVCDecoderConfRecord(t *testing.T) {
+	record := testRecord()
+
+	codec, err := NewCodecDataFromHEVCDecoderConfRecord(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if codec.Width() != 1280 || codec.Height() != 720 {
+		t.Errorf("size %dx%d, want 1280x720", codec.Width(), codec.Height())
+	}
+	if fps := codec.FrameRate(); fps < 29.97 || fps > 29.98 {
+		t.Errorf("frame rate %f, want 29.97", fps)
+	}
+	info := codec.RecordInfo
+	if info.GeneralProfileIdc != 1 || info.GeneralLevelIdc != 93 || info.ChromaFormat != 1 ||
+		info.GeneralProfileCompatibilityFlags != 0x60000000 || info.GeneralConstraintIndicatorFlags != 0x900000000000 ||
+		info.NumTemporalLayers != 1 || info.TemporalIdNested != 1 || info.LengthSizeMinusOne != 3 {
+		t.Errorf("record info %+v", info)
+	}
+	if !bytes.Equal(codec.VPS(), testVPS) || !bytes.Equal(codec.SPS(), testSPS) || !bytes.Equal(codec.PPS(), testPPS) {
+		t.Errorf("parameter sets differ")
+	}
+
+	// and back from the parameter sets
+	codec, err = NewCodecDataFromVPSAndSPSAndPPS(testVPS, testSPS, testPPS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(codec.Record, record) {
+		t.Errorf("record\n% x\nwant\n% x", codec.Record, record)
+	}
+
+	for n := 0; n < len(record); n += 7 {
+		var info HEVCDecoderConfRecord
+		if _, err := info.Unmarshal(record[:n]); err == nil {
+			t.Errorf("record truncated to %d bytes accepted", n)
+		}
+	}
+}
+
+func TestSplitNALUs(t *testing.T) {
+	idr := []byte{0x26, 0x01, 0xaf, 0x1d}
+	var annexb []byte
+	for _, nalu := range [][]byte{testVPS, testSPS, testPPS, idr} {
+		annexb = append(annexb, 0, 0, 0, 1)
+		annexb = append(annexb, nalu...)
+	}
+
+	nalus, typ := SplitNALUs(annexb)
+	if typ != NALU_ANNEXB || len(nalus) != 4 || !bytes.Equal(nalus[3], idr) {
+		t.Fatalf("got %d nalus of type %d", len(nalus), typ)
+	}
+	if NALUType(nalus[0]) != NALU_VPS || NALUType(nalus[3]) != 19 {
+		t.Errorf("nal types %d %d, want %d 19", NALUType(nalus[0]), NALUType(nalus[3]), NALU_VPS)
+	}
+	if !IsKeyFrame(annexb) {
+		t.Errorf("IDR_W_RADL is not a keyframe")
+	}
+}
@@ -0,0 +1,155 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Debug logs everything to stdout, protocol traces included, for the
+// Servers and Conns without a Logger.
+//
+// Deprecated: set Server.Logger or Dialer.Logger, and trace a connection
+// with Conn.SetTrace.
+var Debug bool
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	// LevelTrace is the protocol trace: chunks, commands and their AMF
+	// values. It is only logged for the connections with SetTrace.
+	LevelTrace Level = iota
+	LevelDebug
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (self Level) String() string {
+	switch self {
+	case LevelTrace:
+		return "trace"
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(self))
+}
+
+// Logger receives the log messages of Servers and Conns. keyvals are
+// alternating keys and values, the ones of the connection (remote, app,
+// stream) come first. Log is called from several goroutines.
+type Logger interface {
+	Log(level Level, msg string, keyvals ...interface{})
+}
+
+type textLogger struct {
+	lock sync.Mutex
+	w    io.Writer
+	min  Level
+}
+
+// NewLogger returns a Logger that writes the messages of level min and
+// above to w, one line of key=value pairs each.
+func NewLogger(w io.Writer, min Level) Logger {
+	return &textLogger{w: w, min: min}
+}
+
+func (self *textLogger) Log(level Level, msg string, keyvals ...interface{}) {
+	if level < self.min {
+		return
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s level=%s msg=%s", time.Now().Format(time.RFC3339Nano), level, logValue(msg))
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		fmt.Fprintf(&b, " %v=%s", keyvals[i], logValue(keyvals[i+1]))
+	}
+	b.WriteByte('\n')
+
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.w.Write([]byte(b.String()))
+}
+
+func logValue(val interface{}) string {
+	s := fmt.Sprint(val)
+	if s == "" || strings.ContainsAny(s, " =\"\n") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// debugLogger is used while Debug is set.
+var debugLogger = NewLogger(os.Stdout, LevelTrace)
+
+func (self *Server) log(level Level, msg string, keyvals ...interface{}) {
+	logger := self.Logger
+	if logger == nil {
+		if !Debug {
+			return
+		}
+		logger = debugLogger
+	}
+	logger.Log(level, msg, keyvals...)
+}
+
+// SetLogger sets the logger of the connection of self, call it before
+// Prepare. Conns of a Server start with Server.Logger.
+func (self *Conn) SetLogger(logger Logger) {
+	self.logger = logger
+}
+
+// SetTrace turns the protocol trace of the connection of self on or off,
+// it can be called at any time.
+func (self *Conn) SetTrace(trace bool) {
+	var on int32
+	if trace {
+		on = 1
+	}
+	atomic.StoreInt32(&self.trace, on)
+}
+
+// tracing guards the LevelTrace messages, so that their values are only
+// built when they are logged.
+func (self *Conn) tracing() bool {
+	return Debug || atomic.LoadInt32(&self.trace) != 0
+}
+
+func (self *Conn) log(level Level, msg string, keyvals ...interface{}) {
+	logger := self.logger
+	if logger == nil {
+		if !Debug {
+			return
+		}
+		logger = debugLogger
+	}
+	if level == LevelTrace && !self.tracing() {
+		return
+	}
+
+	fields := make([]interface{}, 0, 6+len(keyvals))
+	if self.netconn != nil {
+		fields = append(fields, "remote", self.netconn.RemoteAddr())
+	}
+	if self.connectpath != "" {
+		fields = append(fields, "app", self.connectpath)
+	}
+	if self.URL != nil {
+		stream := strings.TrimPrefix(self.URL.Path, "/")
+		stream = strings.TrimPrefix(stream, self.connectpath+"/")
+		if stream != "" && stream != self.connectpath {
+			fields = append(fields, "stream", stream)
+		}
+	}
+	logger.Log(level, msg, append(fields, keyvals...)...)
+}
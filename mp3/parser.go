@@ -0,0 +1,189 @@
+package mp3
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+const (
+	MPEG25 = 0
+	MPEG2  = 2
+	MPEG1  = 3
+)
+
+const (
+	LAYER3 = 1
+	LAYER2 = 2
+	LAYER1 = 3
+)
+
+const (
+	STEREO         = 0
+	JOINT_STEREO   = 1
+	DUAL_CHANNEL   = 2
+	SINGLE_CHANNEL = 3
+)
+
+// kbps by [version is MPEG1][layer][bitrate index], index 0 is free format
+var bitrates = [2][4][16]int{
+	// MPEG2, MPEG2.5
+	{
+		{},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 144, 160, 176, 192, 224, 256, 0},
+	},
+	// MPEG1
+	{
+		{},
+		{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 0},
+		{0, 32, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320, 384, 0},
+		{0, 32, 64, 96, 128, 160, 192, 224, 256, 288, 320, 352, 384, 416, 448, 0},
+	},
+}
+
+var sampleRates = [4][3]int{
+	MPEG25: {11025, 12000, 8000},
+	MPEG2:  {22050, 24000, 16000},
+	MPEG1:  {44100, 48000, 32000},
+}
+
+type FrameHeader struct {
+	Version         uint8
+	Layer           uint8
+	Protected       bool
+	Bitrate         int // bits per second, 0 for free format
+	SampleRate      int
+	Padding         bool
+	ChannelMode     uint8
+	SamplesPerFrame int
+	FrameLength     int // 0 for free format
+}
+
+func (self FrameHeader) ChannelCount() int {
+	if self.ChannelMode == SINGLE_CHANNEL {
+		return 1
+	}
+	return 2
+}
+
+func (self FrameHeader) Duration() time.Duration {
+	return time.Second * time.Duration(self.SamplesPerFrame) / time.Duration(self.SampleRate)
+}
+
+func ParseFrameHeader(b []byte) (self FrameHeader, err error) {
+	if len(b) < 4 {
+		err = fmt.Errorf("mp3parser: frame header too short")
+		return
+	}
+	if b[0] != 0xff || b[1]&0xe0 != 0xe0 {
+		err = fmt.Errorf("mp3parser: frame sync invalid")
+		return
+	}
+
+	self.Version = (b[1] >> 3) & 0x3
+	self.Layer = (b[1] >> 1) & 0x3
+	self.Protected = b[1]&0x1 == 0
+	bitrateIndex := b[2] >> 4
+	sampleRateIndex := (b[2] >> 2) & 0x3
+	self.Padding = (b[2]>>1)&0x1 != 0
+	self.ChannelMode = b[3] >> 6
+
+	if self.Version == 1 {
+		err = fmt.Errorf("mp3parser: version reserved")
+		return
+	}
+	if self.Layer == 0 {
+		err = fmt.Errorf("mp3parser: layer reserved")
+		return
+	}
+	if bitrateIndex == 0xf {
+		err = fmt.Errorf("mp3parser: bitrate index invalid")
+		return
+	}
+	if sampleRateIndex == 0x3 {
+		err = fmt.Errorf("mp3parser: sample rate index invalid")
+		return
+	}
+
+	v1 := 0
+	if self.Version == MPEG1 {
+		v1 = 1
+	}
+	self.Bitrate = bitrates[v1][self.Layer][bitrateIndex] * 1000
+	self.SampleRate = sampleRates[self.Version][sampleRateIndex]
+
+	padding := 0
+	if self.Padding {
+		padding = 1
+	}
+
+	switch self.Layer {
+	case LAYER1:
+		self.SamplesPerFrame = 384
+		self.FrameLength = (12*self.Bitrate/self.SampleRate + padding) * 4
+	case LAYER2:
+		self.SamplesPerFrame = 1152
+		self.FrameLength = 144*self.Bitrate/self.SampleRate + padding
+	case LAYER3:
+		if self.Version == MPEG1 {
+			self.SamplesPerFrame = 1152
+			self.FrameLength = 144*self.Bitrate/self.SampleRate + padding
+		} else {
+			self.SamplesPerFrame = 576
+			self.FrameLength = 72*self.Bitrate/self.SampleRate + padding
+		}
+	}
+
+	return
+}
+
+type CodecData struct {
+	Header FrameHeader
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.MP3
+}
+
+func (self CodecData) ChannelLayout() av.ChannelLayout {
+	if self.Header.ChannelCount() == 1 {
+		return av.CH_MONO
+	}
+	return av.CH_STEREO
+}
+
+func (self CodecData) SampleRate() int {
+	return self.Header.SampleRate
+}
+
+func (self CodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+// PacketDuration sums the frames in the packet, flv usually carries one.
+func (self CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	for len(data) > 0 {
+		var hdr FrameHeader
+		if hdr, err = ParseFrameHeader(data); err != nil {
+			return
+		}
+		dur += hdr.Duration()
+		if hdr.FrameLength == 0 || hdr.FrameLength > len(data) {
+			break
+		}
+		data = data[hdr.FrameLength:]
+	}
+	return
+}
+
+// NewCodecDataFromFrame takes the stream parameters from the first frame,
+// mp3 has no decoder config.
+func NewCodecDataFromFrame(frame []byte) (self CodecData, err error) {
+	if self.Header, err = ParseFrameHeader(frame); err != nil {
+		return
+	}
+	return
+}
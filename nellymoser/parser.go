@@ -0,0 +1,53 @@
+package nellymoser
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// Each 64 byte block decodes to 256 mono samples.
+const (
+	BlockSize    = 64
+	BlockSamples = 256
+)
+
+type CodecData struct {
+	sampleRate int
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.NELLYMOSER
+}
+
+func (self CodecData) ChannelLayout() av.ChannelLayout {
+	return av.CH_MONO
+}
+
+func (self CodecData) SampleRate() int {
+	return self.sampleRate
+}
+
+func (self CodecData) SampleFormat() av.SampleFormat {
+	return av.FLT
+}
+
+func (self CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	if len(data)%BlockSize != 0 {
+		err = fmt.Errorf("nellymoser: packet size %d is not a multiple of %d", len(data), BlockSize)
+		return
+	}
+	samples := len(data) / BlockSize * BlockSamples
+	dur = time.Duration(samples) * time.Second / time.Duration(self.sampleRate)
+	return
+}
+
+func NewCodecData(samplerate int) (self CodecData, err error) {
+	if samplerate <= 0 {
+		err = fmt.Errorf("nellymoser: sample rate %d invalid", samplerate)
+		return
+	}
+	self.sampleRate = samplerate
+	return
+}
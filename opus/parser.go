@@ -0,0 +1,230 @@
+package opus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pio"
+)
+
+// Opus always decodes at 48kHz, whatever the input sample rate was.
+const SampleRate = 48000
+
+// frame duration in 1/10 ms by TOC config, RFC 6716 section 3.1
+var frameDurations = [32]int{
+	100, 200, 400, 600, // SILK NB
+	100, 200, 400, 600, // SILK MB
+	100, 200, 400, 600, // SILK WB
+	100, 200, // Hybrid SWB
+	100, 200, // Hybrid FB
+	25, 50, 100, 200, // CELT NB
+	25, 50, 100, 200, // CELT WB
+	25, 50, 100, 200, // CELT SWB
+	25, 50, 100, 200, // CELT FB
+}
+
+type TOC struct {
+	Config      uint8
+	Stereo      bool
+	FrameCount  int
+	FrameLength time.Duration
+}
+
+func ParseTOC(packet []byte) (self TOC, err error) {
+	if len(packet) < 1 {
+		err = fmt.Errorf("opusparser: packet empty")
+		return
+	}
+	toc := packet[0]
+	self.Config = toc >> 3
+	self.Stereo = toc&0x4 != 0
+	self.FrameLength = time.Duration(frameDurations[self.Config]) * time.Millisecond / 10
+
+	switch toc & 0x3 {
+	case 0:
+		self.FrameCount = 1
+	case 1, 2:
+		self.FrameCount = 2
+	case 3:
+		if len(packet) < 2 {
+			err = fmt.Errorf("opusparser: code 3 packet missing frame count")
+			return
+		}
+		self.FrameCount = int(packet[1] & 0x3f)
+		if self.FrameCount == 0 {
+			err = fmt.Errorf("opusparser: code 3 packet with no frames")
+			return
+		}
+	}
+	return
+}
+
+// PacketDuration returns the duration of all frames in the packet, at most
+// 120ms.
+func PacketDuration(packet []byte) (dur time.Duration, err error) {
+	var toc TOC
+	if toc, err = ParseTOC(packet); err != nil {
+		return
+	}
+	dur = toc.FrameLength * time.Duration(toc.FrameCount)
+	if dur > 120*time.Millisecond {
+		err = fmt.Errorf("opusparser: packet duration %v invalid", dur)
+		return
+	}
+	return
+}
+
+// OpusHead is the identification header of RFC 7845 section 5.1, it is also
+// the Enhanced RTMP sequence start payload.
+type OpusHead struct {
+	Version              uint8
+	ChannelCount         uint8
+	PreSkip              uint16
+	InputSampleRate      uint32
+	OutputGain           int16
+	ChannelMappingFamily uint8
+	StreamCount          uint8
+	CoupledCount         uint8
+	ChannelMapping       []uint8
+}
+
+var ErrOpusHeadInvalid = fmt.Errorf("opusparser: OpusHead invalid")
+
+func (self *OpusHead) Unmarshal(b []byte) (n int, err error) {
+	if len(b) < 19 || string(b[0:8]) != "OpusHead" {
+		err = ErrOpusHeadInvalid
+		return
+	}
+	self.Version = b[8]
+	self.ChannelCount = b[9]
+	self.PreSkip = uint16(b[10]) | uint16(b[11])<<8
+	self.InputSampleRate = pio.U32LE(b[12:])
+	self.OutputGain = int16(uint16(b[16]) | uint16(b[17])<<8)
+	self.ChannelMappingFamily = b[18]
+	n += 19
+
+	if self.ChannelCount == 0 {
+		err = ErrOpusHeadInvalid
+		return
+	}
+
+	if self.ChannelMappingFamily != 0 {
+		if len(b) < n+2+int(self.ChannelCount) {
+			err = ErrOpusHeadInvalid
+			return
+		}
+		self.StreamCount = b[n]
+		self.CoupledCount = b[n+1]
+		n += 2
+		self.ChannelMapping = b[n : n+int(self.ChannelCount)]
+		n += int(self.ChannelCount)
+	}
+
+	return
+}
+
+func (self OpusHead) Len() (n int) {
+	n = 19
+	if self.ChannelMappingFamily != 0 {
+		n += 2 + len(self.ChannelMapping)
+	}
+	return
+}
+
+func (self OpusHead) Marshal(b []byte) (n int) {
+	copy(b[0:8], "OpusHead")
+	b[8] = self.Version
+	b[9] = self.ChannelCount
+	b[10] = uint8(self.PreSkip)
+	b[11] = uint8(self.PreSkip >> 8)
+	pio.PutU32LE(b[12:], self.InputSampleRate)
+	b[16] = uint8(self.OutputGain)
+	b[17] = uint8(uint16(self.OutputGain) >> 8)
+	b[18] = self.ChannelMappingFamily
+	n += 19
+
+	if self.ChannelMappingFamily != 0 {
+		b[n] = self.StreamCount
+		b[n+1] = self.CoupledCount
+		n += 2
+		copy(b[n:], self.ChannelMapping)
+		n += len(self.ChannelMapping)
+	}
+	return
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo OpusHead
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.OPUS
+}
+
+func (self CodecData) OpusHeadBytes() []byte {
+	return self.Record
+}
+
+// vorbisLayouts are the layouts of the Vorbis channel order of mapping
+// family 1, RFC 7845 section 5.1.1.2, by channel count.
+var vorbisLayouts = [9]av.ChannelLayout{
+	1: av.CH_MONO,
+	2: av.CH_STEREO,
+	3: av.CH_SURROUND,
+	4: av.CH_STEREO | av.CH_BACK_LEFT | av.CH_BACK_RIGHT,
+	5: av.CH_SURROUND | av.CH_BACK_LEFT | av.CH_BACK_RIGHT,
+	6: av.CH_SURROUND | av.CH_BACK_LEFT | av.CH_BACK_RIGHT | av.CH_LOW_FREQ,
+	7: av.CH_SURROUND | av.CH_SIDE_LEFT | av.CH_SIDE_RIGHT | av.CH_BACK_CENTER | av.CH_LOW_FREQ,
+	8: av.CH_SURROUND | av.CH_SIDE_LEFT | av.CH_SIDE_RIGHT | av.CH_BACK_LEFT | av.CH_BACK_RIGHT | av.CH_LOW_FREQ,
+}
+
+// ChannelLayout returns 0 when the channels have no defined positions:
+// more than 2 channels outside of mapping family 1, or more than 8.
+func (self CodecData) ChannelLayout() av.ChannelLayout {
+	count := int(self.RecordInfo.ChannelCount)
+	if count > 2 && self.RecordInfo.ChannelMappingFamily != 1 || count >= len(vorbisLayouts) {
+		return 0
+	}
+	return vorbisLayouts[count]
+}
+
+func (self CodecData) SampleRate() int {
+	return SampleRate
+}
+
+func (self CodecData) SampleFormat() av.SampleFormat {
+	return av.FLTP
+}
+
+func (self CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	return PacketDuration(data)
+}
+
+func NewCodecDataFromOpusHead(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+	return
+}
+
+// NewCodecData makes a mono or stereo OpusHead, for streams that have no
+// sequence start.
+func NewCodecData(channels int) (self CodecData, err error) {
+	if channels != 1 && channels != 2 {
+		err = fmt.Errorf("opusparser: %d channels needs a channel mapping", channels)
+		return
+	}
+	head := OpusHead{
+		Version:         1,
+		ChannelCount:    uint8(channels),
+		PreSkip:         3840,
+		InputSampleRate: SampleRate,
+	}
+	self.Record = make([]byte, head.Len())
+	head.Marshal(self.Record)
+	self.RecordInfo = head
+	return
+}
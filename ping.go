@@ -0,0 +1,113 @@
+package rtmp
+
+import (
+	"fmt"
+	"time"
+)
+
+// RTT is the smoothed round-trip time measured with pings, 0 until a
+// PingResponse came. Only servers send PingRequest, so it stays 0 on the
+// client side.
+func (self *Conn) RTT() time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.rtt
+}
+
+// LastSeen is when the last message came from the peer.
+func (self *Conn) LastSeen() time.Time {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.lastSeen
+}
+
+// Ping sends a PingRequest, its PingResponse updates RTT. It needs a
+// server connection that is done with connect.
+func (self *Conn) Ping() (err error) {
+	if !self.isserver || self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: Ping needs a connected server connection")
+		return
+	}
+	return self.sendPing()
+}
+
+func (self *Conn) sendPing() (err error) {
+	self.lock.Lock()
+	self.pingSent = time.Now()
+	self.pingts = uint32(self.pingSent.Sub(self.start) / time.Millisecond)
+	ts := self.pingts
+	self.lock.Unlock()
+
+	// > PingRequest
+	if self.tracing() {
+		self.log(LevelTrace, "> PingRequest", "ts", ts)
+	}
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err = self.writePing(eventtypePingRequest, ts); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Conn) pingLoop() {
+	ticker := time.NewTicker(self.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := self.sendPing(); err != nil {
+				return
+			}
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+func (self *Conn) handlePing(eventtype uint16, ts uint32) (err error) {
+	switch eventtype {
+	case eventtypePingRequest:
+		// < PingRequest
+		// > PingResponse
+		if self.tracing() {
+			self.log(LevelTrace, "< PingRequest", "ts", ts)
+		}
+		// a failed write is left to the read side, which then sees how
+		// the peer went away
+		self.wlock.Lock()
+		defer self.wlock.Unlock()
+		if self.writePing(eventtypePingResponse, ts) == nil {
+			self.flushWrite()
+		}
+
+	case eventtypePingResponse:
+		// < PingResponse
+		if self.tracing() {
+			self.log(LevelTrace, "< PingResponse", "ts", ts)
+		}
+		self.lock.Lock()
+		defer self.lock.Unlock()
+		if self.pingSent.IsZero() || ts != self.pingts {
+			return
+		}
+		sample := time.Since(self.pingSent)
+		self.pingSent = time.Time{}
+		// smoothed as the tcp srtt, RFC 6298
+		if self.rtt == 0 {
+			self.rtt = sample
+		} else {
+			self.rtt += (sample - self.rtt) / 8
+		}
+	}
+	return
+}
+
+// writePing writes a ping event, it carries a timestamp where the stream
+// events carry a stream id.
+func (self *Conn) writePing(eventtype uint16, ts uint32) (err error) {
+	return self.writeStreamEvent(eventtype, ts)
+}
@@ -3,15 +3,18 @@ package rtmp
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/hex"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"net"
 	"net/url"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/notedit/rtmp-lib/av"
@@ -19,81 +22,430 @@ import (
 	"github.com/notedit/rtmp-lib/pio"
 )
 
-var Debug bool
-
 func ParseURL(uri string) (u *url.URL, err error) {
 	if u, err = url.Parse(uri); err != nil {
 		return
 	}
 	if _, _, serr := net.SplitHostPort(u.Host); serr != nil {
-		u.Host += ":1935"
+		u.Host += ":" + defaultPort(u.Scheme)
 	}
 	return
 }
 
+func defaultPort(scheme string) string {
+	switch scheme {
+	case "rtmps":
+		return "443"
+	case "rtmpt":
+		return "80"
+	}
+	return "1935"
+}
+
+// Dialer contains options for connecting to a rtmp url.
+type Dialer struct {
+	// Timeout is the maximum amount of time the tcp dial (and the tls
+	// handshake for rtmps) will wait. Zero means no timeout.
+	Timeout time.Duration
+
+	// TLSConfig is used for rtmps urls. If nil, the default configuration
+	// is used. ServerName is filled from the url host when empty.
+	TLSConfig *tls.Config
+
+	// SimpleHandshake disables the flash player 9 digest handshake.
+	// It has no effect on rtmpe urls, which always use the encrypted one.
+	// By default the digest handshake is tried, and the connection falls
+	// back to the simple handshake when the server doesn't sign S1.
+	SimpleHandshake bool
+
+	// PlayOptions are sent with play when the connection is used for
+	// reading. If nil, a bare play(path) is sent.
+	PlayOptions *PlayOptions
+
+	// ChunkSize is sent in SetChunkSize after the handshake, outgoing
+	// messages are split into chunks of this size. Zero means
+	// DefaultChunkSize.
+	ChunkSize int
+
+	// FullChunkHeaders makes every message start with a type 0 chunk
+	// header, for servers that mishandle the compressed ones.
+	FullChunkHeaders bool
+
+	// WindowFullError makes WritePacket return ErrWindowFull when the
+	// bandwidth limit set by the server is used up, instead of waiting for
+	// its Ack. A server that never sends an Ack has its limit ignored once
+	// a write waited 10s for one.
+	WindowFullError bool
+
+	// Timeouts of the connection, DialContext is bounded by its context
+	// as well.
+	Timeouts Timeouts
+
+	// Logger of the connection and of its rtmpt tunnel, nil logs nothing.
+	// Trace turns its protocol trace on, see Conn.SetTrace.
+	Logger Logger
+	Trace  bool
+}
+
 func Dial(uri string) (conn *Conn, err error) {
 	return DialTimeout(uri, 0)
 }
 
 func DialTimeout(uri string, timeout time.Duration) (conn *Conn, err error) {
+	dialer := &Dialer{Timeout: timeout}
+	return dialer.Dial(uri)
+}
+
+// DialContext connects to uri and runs the handshake, connect and
+// createStream, only publish or play are left to WriteHeader or
+// ReadPacket. ctx bounds all of it, it has no effect on the connection
+// once DialContext returned. DialPublishContext and DialPlayContext bound
+// the publish or play as well.
+func DialContext(ctx context.Context, uri string) (conn *Conn, err error) {
+	dialer := &Dialer{}
+	return dialer.DialContext(ctx, uri)
+}
+
+// DialPublishContext is like DialContext, and sends publish before it
+// returns, WriteHeader is left.
+func DialPublishContext(ctx context.Context, uri string) (conn *Conn, err error) {
+	dialer := &Dialer{}
+	return dialer.DialPublishContext(ctx, uri)
+}
+
+// DialPlayContext is like DialContext, and sends play before it returns,
+// the streams are read by the first Streams or ReadPacket.
+func DialPlayContext(ctx context.Context, uri string) (conn *Conn, err error) {
+	dialer := &Dialer{}
+	return dialer.DialPlayContext(ctx, uri)
+}
+
+// Dial connects to uri, the rtmp handshake and commands are left to
+// Prepare, WriteHeader or ReadPacket.
+func (self *Dialer) Dial(uri string) (conn *Conn, err error) {
+	return self.dial(context.Background(), uri)
+}
+
+// DialContext is like the package DialContext.
+func (self *Dialer) DialContext(ctx context.Context, uri string) (conn *Conn, err error) {
+	return self.dialContext(ctx, uri, 0)
+}
+
+// DialPublishContext is like the package DialPublishContext.
+func (self *Dialer) DialPublishContext(ctx context.Context, uri string) (conn *Conn, err error) {
+	return self.dialContext(ctx, uri, prepareWriting)
+}
+
+// DialPlayContext is like the package DialPlayContext.
+func (self *Dialer) DialPlayContext(ctx context.Context, uri string) (conn *Conn, err error) {
+	return self.dialContext(ctx, uri, prepareReading)
+}
+
+// dialContext runs the commands up to createStream, and publish or play
+// when flags is prepareWriting or prepareReading, under ctx.
+func (self *Dialer) dialContext(ctx context.Context, uri string, flags int) (conn *Conn, err error) {
+	if conn, err = self.dial(ctx, uri); err != nil {
+		return
+	}
+
+	stop := watchContext(ctx, conn.netconn)
+	if err = conn.prepare(stageHandshakeDone, 0); err == nil {
+		if flags != 0 {
+			err = conn.prepare(stageCommandDone, flags)
+		} else {
+			timeout := conn.Timeouts().Command
+			conn.setPhaseDeadline(timeout)
+			err = conn.endPhase(conn.connectStream(), "command", timeout)
+		}
+	}
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		conn.Close()
+		conn = nil
+		return
+	}
+	return
+}
+
+func (self *Dialer) dial(ctx context.Context, uri string) (conn *Conn, err error) {
 	var u *url.URL
 	if u, err = ParseURL(uri); err != nil {
 		return
 	}
 
-	dailer := net.Dialer{Timeout: timeout}
+	if self.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, self.Timeout)
+		defer cancel()
+	}
+
+	dailer := &net.Dialer{}
 	var netconn net.Conn
-	if netconn, err = dailer.Dial("tcp", u.Host); err != nil {
-		return
+	switch u.Scheme {
+	case "rtmpt":
+		if netconn, err = dialTunnel(ctx, u.Host, self.Timeout, self.Logger); err != nil {
+			return
+		}
+	case "rtmps":
+		if netconn, err = dailer.DialContext(ctx, "tcp", u.Host); err != nil {
+			return
+		}
+		if netconn, err = self.handshakeTLS(ctx, netconn, u); err != nil {
+			return
+		}
+	default:
+		if netconn, err = dailer.DialContext(ctx, "tcp", u.Host); err != nil {
+			return
+		}
 	}
 
 	conn = NewConn(netconn, 1024*100)
 	conn.URL = u
+	conn.simpleHandshake = self.SimpleHandshake
+	conn.encrypted = u.Scheme == "rtmpe"
+	conn.PlayOptions = self.PlayOptions
+	conn.chunkSize = validChunkSize(self.ChunkSize)
+	conn.fullChunkHeaders = self.FullChunkHeaders
+	conn.windowFullError = self.WindowFullError
+	conn.SetTimeouts(self.Timeouts)
+	conn.logger = self.Logger
+	conn.SetTrace(self.Trace)
+	return
+}
+
+func (self *Dialer) handshakeTLS(ctx context.Context, rawconn net.Conn, u *url.URL) (netconn net.Conn, err error) {
+	var config *tls.Config
+	if self.TLSConfig != nil {
+		config = self.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if config.ServerName == "" {
+		config.ServerName, _, _ = net.SplitHostPort(u.Host)
+	}
+
+	tlsconn := tls.Client(rawconn, config)
+	stop := watchContext(ctx, rawconn)
+	err = tlsconn.Handshake()
+	if cerr := stop(); cerr != nil {
+		err = cerr
+	}
+	if err != nil {
+		rawconn.Close()
+		return
+	}
+	netconn = tlsconn
 	return
 }
 
+// watchContext interrupts the i/o on netconn when ctx is done, until stop
+// is called. stop returns the ctx error if that happened.
+func watchContext(ctx context.Context, netconn net.Conn) (stop func() error) {
+	if ctx.Done() == nil {
+		return func() error { return nil }
+	}
+
+	done := make(chan struct{})
+	fired := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			netconn.SetDeadline(time.Unix(1, 0))
+			fired <- ctx.Err()
+		case <-done:
+			fired <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		if err := <-fired; err != nil {
+			netconn.SetDeadline(time.Time{})
+			return err
+		}
+		return nil
+	}
+}
+
 type Config struct {
+	// ChunkSize is sent in SetChunkSize to every connection, outgoing
+	// messages are split into chunks of this size. Zero means
+	// DefaultChunkSize.
 	ChunkSize  int
 	BufferSize int
+
+	// FullChunkHeaders makes every message start with a type 0 chunk
+	// header, for peers that mishandle the compressed ones.
+	FullChunkHeaders bool
+
+	// WindowFullError makes WritePacket return ErrWindowFull when the
+	// bandwidth limit set by the peer is used up, instead of waiting for
+	// its Ack. A peer that never sends an Ack has its limit ignored once
+	// a write waited 10s for one.
+	WindowFullError bool
+
+	// PingInterval is how often connections are sent a PingRequest, which
+	// keeps them alive and measures Conn.RTT. Zero means no pings.
+	PingInterval time.Duration
+
+	// Timeouts of every connection.
+	Timeouts Timeouts
+}
+
+// DefaultChunkSize is the chunk size used when Config or Dialer leave it
+// zero.
+const DefaultChunkSize = 4096
+
+// maxChunkSize is the largest chunk size SetChunkSize can carry.
+const maxChunkSize = 0xFFFFFF
+
+func validChunkSize(size int) int {
+	if size <= 0 {
+		return DefaultChunkSize
+	}
+	if size > maxChunkSize {
+		return maxChunkSize
+	}
+	return size
 }
 
 type Server struct {
 	config        *Config
 	Addr          string
+	TLSConfig     *tls.Config
 	HandlePublish func(*Conn)
 	HandlePlay    func(*Conn)
 	HandleConn    func(*Conn)
+
+	// Logger of the server and its connections, nil logs nothing. Turn
+	// the protocol trace of a connection on with Conn.SetTrace from
+	// HandleConn.
+	Logger Logger
+
+	lock      sync.Mutex
+	commands  map[string]CommandHandler
+	listeners map[net.Listener]struct{}
+	// handlers running per connection
+	conns    map[*Conn]int
+	shutdown bool
+}
+
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown or
+// Close.
+var ErrServerClosed = fmt.Errorf("rtmp: Server closed")
+
+// ErrStreamQueueFull is returned by ReadPacket of a stream that was read too
+// slowly while other streams shared its connection.
+var ErrStreamQueueFull = fmt.Errorf("rtmp: stream queue full")
+
+// ErrWindowFull is returned by WritePacket when the peer's bandwidth limit
+// is used up and WindowFullError is set.
+var ErrWindowFull = fmt.Errorf("rtmp: peer window full")
+
+// CommandHandler answers a command sent by the peer. The result values are
+// sent back in _result, a non nil error is sent back as _error. Nothing is
+// sent back when transid is 0.
+//
+// Handlers run on the read loop of the connection, so they should return
+// quickly and must not use Call on the same connection.
+type CommandHandler func(conn *Conn, transid float64, obj flv.AMFMap, params []interface{}) (result []interface{}, err error)
+
+// HandleCommand registers the handler for the command name on every
+// connection accepted afterwards.
+func (self *Server) HandleCommand(name string, handler CommandHandler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.commands == nil {
+		self.commands = make(map[string]CommandHandler)
+	}
+	self.commands[name] = handler
 }
 
 func NewServer(config *Config) *Server {
 	server := &Server{
-		config:config,
+		config: config,
 	}
 	return server
 }
 
+// serveConn runs the handlers of conn, the connection is closed once they
+// all returned.
+func (self *Server) serveConn(conn *Conn) {
+	if self.shuttingDown() {
+		conn.Close()
+		return
+	}
+	self.trackConn(conn, 1)
+	go func() {
+		defer self.trackConn(conn, -1)
+		err := self.handleConn(conn)
+		self.log(LevelInfo, "connection closed", "remote", conn.netconn.RemoteAddr(), "err", err)
+	}()
+}
+
+func (self *Server) trackConn(conn *Conn, delta int) {
+	self.lock.Lock()
+	if self.conns == nil {
+		self.conns = make(map[*Conn]int)
+	}
+	self.conns[conn] += delta
+	if self.conns[conn] > 0 {
+		self.lock.Unlock()
+		return
+	}
+	delete(self.conns, conn)
+	self.lock.Unlock()
+
+	// the last packets of the handlers may still be buffered
+	conn.wlock.Lock()
+	conn.flushWrite()
+	conn.wlock.Unlock()
+	conn.Close()
+}
+
 func (self *Server) handleConn(conn *Conn) (err error) {
+	conn.onStream = func(stream *Conn) {
+		self.trackConn(conn, 1)
+		go func() {
+			defer self.trackConn(conn, -1)
+			self.handleStream(stream)
+		}()
+	}
+
 	if self.HandleConn != nil {
 		self.HandleConn(conn)
 	} else {
 		if err = conn.prepare(stageCommandDone, 0); err != nil {
 			return
 		}
-
-		if conn.playing {
-			if self.HandlePlay != nil {
-				self.HandlePlay(conn)
-			}
-		} else if conn.publishing {
-			if self.HandlePublish != nil {
-				self.HandlePublish(conn)
-			}
-		}
+		self.handleStream(conn)
 	}
 
 	return
 }
 
+// handleStream runs the callbacks for one stream, the first stream of a
+// connection runs in handleConn, the others in their own goroutine.
+func (self *Server) handleStream(conn *Conn) {
+	if self.HandleConn != nil {
+		self.HandleConn(conn)
+		return
+	}
+
+	if conn.playing {
+		if self.HandlePlay != nil {
+			self.HandlePlay(conn)
+		}
+	} else if conn.publishing {
+		if self.HandlePublish != nil {
+			self.HandlePublish(conn)
+		}
+	}
+	conn.detach()
+}
+
 func (self *Server) ListenAndServe() (err error) {
 	addr := self.Addr
 	if addr == "" {
@@ -110,30 +462,170 @@ func (self *Server) ListenAndServe() (err error) {
 		return
 	}
 
-	if Debug {
-		fmt.Println("rtmp: server: listening on", addr)
+	self.log(LevelInfo, "listening", "addr", addr)
+
+	return self.Serve(listener)
+}
+
+// ListenAndServeTLS listens for rtmps connections. certFile and keyFile are
+// loaded into a copy of self.TLSConfig, they can be left empty when
+// self.TLSConfig already carries certificates.
+func (self *Server) ListenAndServeTLS(certFile, keyFile string) (err error) {
+	addr := self.Addr
+	if addr == "" {
+		addr = ":443"
+	}
+
+	var config *tls.Config
+	if self.TLSConfig != nil {
+		config = self.TLSConfig.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+	if len(config.Certificates) == 0 || certFile != "" || keyFile != "" {
+		var cert tls.Certificate
+		if cert, err = tls.LoadX509KeyPair(certFile, keyFile); err != nil {
+			err = fmt.Errorf("rtmp: ListenAndServeTLS: %s", err)
+			return
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	var listener net.Listener
+	if listener, err = net.Listen("tcp", addr); err != nil {
+		return
 	}
 
+	self.log(LevelInfo, "listening tls", "addr", addr)
+
+	return self.Serve(tls.NewListener(listener, config))
+}
+
+func (self *Server) newConn(netconn net.Conn) *Conn {
+	buffersize := 1024 * 100
+	chunksize := 0
+	fullheaders := false
+	windowerror := false
+	var pinginterval time.Duration
+	var timeouts Timeouts
+	if self.config != nil {
+		buffersize = self.config.BufferSize
+		chunksize = self.config.ChunkSize
+		fullheaders = self.config.FullChunkHeaders
+		windowerror = self.config.WindowFullError
+		pinginterval = self.config.PingInterval
+		timeouts = self.config.Timeouts
+	}
+	conn := NewConn(netconn, buffersize)
+	conn.isserver = true
+	conn.chunkSize = validChunkSize(chunksize)
+	conn.fullChunkHeaders = fullheaders
+	conn.windowFullError = windowerror
+	conn.pingInterval = pinginterval
+	conn.SetTimeouts(timeouts)
+	conn.logger = self.Logger
+
+	self.lock.Lock()
+	for name, handler := range self.commands {
+		conn.commands[name] = handler
+	}
+	self.lock.Unlock()
+	return conn
+}
+
+// Serve accepts connections on listener until it fails, or Shutdown or
+// Close is called.
+func (self *Server) Serve(listener net.Listener) (err error) {
+	if !self.trackListener(listener, true) {
+		err = ErrServerClosed
+		return
+	}
+	defer self.trackListener(listener, false)
 
 	for {
 		var netconn net.Conn
 		if netconn, err = listener.Accept(); err != nil {
+			if self.shuttingDown() {
+				err = ErrServerClosed
+			}
 			return
 		}
 
-		if Debug {
-			fmt.Println("rtmp: server: accepted")
+		self.log(LevelDebug, "accepted", "remote", netconn.RemoteAddr())
+
+		self.serveConn(self.newConn(netconn))
+	}
+}
+
+func (self *Server) trackListener(listener net.Listener, add bool) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.listeners == nil {
+		self.listeners = make(map[net.Listener]struct{})
+	}
+	if add {
+		if self.shutdown {
+			return false
+		}
+		self.listeners[listener] = struct{}{}
+	} else {
+		delete(self.listeners, listener)
+	}
+	return true
+}
+
+func (self *Server) shuttingDown() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.shutdown
+}
+
+func (self *Server) closeListeners() (err error) {
+	self.shutdown = true
+	for listener := range self.listeners {
+		if cerr := listener.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
+		delete(self.listeners, listener)
+	}
+	return
+}
 
-		conn := NewConn(netconn, self.config.BufferSize)
-		conn.isserver = true
-		go func() {
-			err := self.handleConn(conn)
-			if Debug {
-				fmt.Println("rtmp: server: client closed err:", err)
-			}
-		}()
+// Shutdown stops accepting connections and waits for the running handlers
+// to return, or for ctx to be done.
+func (self *Server) Shutdown(ctx context.Context) (err error) {
+	self.lock.Lock()
+	err = self.closeListeners()
+	self.lock.Unlock()
+
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		self.lock.Lock()
+		active := len(self.conns)
+		self.lock.Unlock()
+		if active == 0 {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close stops accepting connections and closes the live ones, it does not
+// wait for the handlers.
+func (self *Server) Close() (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	err = self.closeListeners()
+	for conn := range self.conns {
+		conn.Close()
 	}
+	return
 }
 
 const (
@@ -147,37 +639,119 @@ const (
 	prepareWriting
 )
 
+// Conn is one message stream of a rtmp connection. The first stream is the
+// Conn returned by Dial or passed to the server callbacks, more streams can
+// share its connection, see Publish and Play.
 type Conn struct {
-	URL             *url.URL
+	URL *url.URL
+	// OnPlayOrPublish checks a publish on the server with the connect
+	// params, a non nil error refuses it, see StatusError.
 	OnPlayOrPublish func(string, flv.AMFMap) error
 
+	// PlayOptions are the play arguments, parsed from the player on the
+	// server and sent to the server by a client.
+	PlayOptions *PlayOptions
+
+	// OnPlay2 is called from the read loop when the player switches a
+	// playing stream with play2, the handler should switch its source. A
+	// non nil error refuses the transition. Like OnPlayOrPublish, set it
+	// before Prepare, the streams opened later inherit it.
+	OnPlay2 func(*Conn, Play2Options) error
+
+	*session
+
 	prober  *flv.Prober
 	streams []av.CodecData
 
-	txbytes uint64
-	rxbytes uint64
+	publishing, playing bool
+	reading, writing    bool
+	stage               int
+
+	avmsgsid uint32
+	// client connect and createStream are done
+	streamCreated bool
+
+	avtags chan avTag
+	done   chan struct{}
+	// returned by ReadPacket once avtags is closed
+	closeerr error
+
+	// pause and seek for PlaySource
+	vodctl chan vodCommand
+
+	// first packet time and end of a duration bounded play, playstart
+	// and playstarted are guarded by lock
+	playstart   time.Duration
+	playstarted bool
+	playdone    bool
 
+	// packets read or written, by stream index
+	statslock sync.Mutex
+	stats     []streamStats
+}
+
+// session is the connection state shared by all the streams.
+type session struct {
 	bufr *bufio.Reader
 	bufw *bufio.Writer
-	ackn uint32
+	// bytes read and the count at the last Ack sent
+	ackn    uint32
+	acklast uint32
 
 	writebuf []byte
 	readbuf  []byte
 
 	netconn   net.Conn
 	txrxcount *txrxcount
+	// netconn with the ReadIdle and Write timeouts
+	tconn *timeoutConn
+
+	logger Logger
+	// protocol trace, 0 or 1 with atomic access
+	trace int32
 
 	writeMaxChunkSize int
 	readMaxChunkSize  int
 	readAckSize       uint32
+	writeAckSize      uint32
 	readcsmap         map[uint32]*chunkStream
-
-	isserver            bool
-	publishing, playing bool
-	reading, writing    bool
-	stage               int
-
-	avmsgsid uint32
+	writecsmap        map[uint32]*chunkStream
+	// fullChunkHeaders disables type 1, 2 and 3 headers on the first chunk
+	// of a message
+	fullChunkHeaders bool
+
+	// flow control, guarded by lock. Ack sequence numbers count the chunk
+	// bytes written, peerBandwidth is the limit of unacknowledged ones.
+	writeBytes    uint32
+	peerAcked     uint32
+	peerAckTime   time.Time
+	peerBandwidth uint32
+	peerLimitType uint8
+	// no Ack came within peerAckTimeout of a full window
+	peerNoAcks bool
+	// closed and replaced when an Ack or SetPeerBandwidth comes
+	ackwait         chan struct{}
+	windowFullError bool
+
+	// pings, guarded by lock. Ping timestamps are milliseconds since
+	// start, only the last PingRequest sent is waited for.
+	start        time.Time
+	pingInterval time.Duration
+	pingSent     time.Time
+	pingts       uint32
+	rtt          time.Duration
+	lastSeen     time.Time
+
+	isserver        bool
+	simpleHandshake bool
+	encrypted       bool
+
+	// enhanced rtmp codecs announced by the peer, nil if it sent none
+	peerFourCcList []string
+
+	tcurl         string
+	connectpath   string
+	connectparams flv.AMFMap
 
 	gotcommand     bool
 	commandname    string
@@ -187,43 +761,97 @@ type Conn struct {
 
 	gotmsg      bool
 	timestamp   uint32
+	msgsid      uint32
 	msgdata     []byte
 	msgtypeid   uint8
 	datamsgvals []interface{}
 	avtag       flv.Tag
 
 	eventtype uint16
+
+	// wlock serializes writes once the read loop runs
+	wlock sync.Mutex
+	// held by a message on the audio or video chunk stream until its last
+	// chunk is written
+	audiolock sync.Mutex
+	videolock sync.Mutex
+
+	// sent in SetChunkSize
+	chunkSize int
+
+	lock       sync.Mutex
+	commands   map[string]CommandHandler
+	msgstreams map[uint32]*Conn
+	// streams ended by endStream, their media is not handed to another
+	endedsids map[uint32]bool
+	nextsid   uint32
+	transid   float64
+	calls     map[float64]chan *callResult
+	// onStream starts the handler of a new stream, it must not block
+	onStream func(*Conn)
+	readerr  error
+	closed   chan struct{}
+}
+
+type avTag struct {
+	tag       flv.Tag
+	timestamp uint32
+}
+
+// streamQueueLen is how many packets a stream may fall behind the read loop,
+// about 10s of audio and 30fps video.
+const streamQueueLen = 1024
+
+type callResult struct {
+	name   string
+	obj    flv.AMFMap
+	params []interface{}
 }
 
+// txrxcount counts the bytes of the connection, the counters are read
+// with atomic loads from any goroutine.
 type txrxcount struct {
-	io.ReadWriter
 	txbytes uint64
 	rxbytes uint64
+	io.ReadWriter
 }
 
 func (self *txrxcount) Read(p []byte) (int, error) {
 	n, err := self.ReadWriter.Read(p)
-	self.rxbytes += uint64(n)
+	atomic.AddUint64(&self.rxbytes, uint64(n))
 	return n, err
 }
 
 func (self *txrxcount) Write(p []byte) (int, error) {
 	n, err := self.ReadWriter.Write(p)
-	self.txbytes += uint64(n)
+	atomic.AddUint64(&self.txbytes, uint64(n))
 	return n, err
 }
 
 // NewConn  buffersize better be  > 1024
 func NewConn(netconn net.Conn, buffersize int) *Conn {
-	conn := &Conn{}
+	conn := &Conn{session: &session{}}
 	conn.prober = &flv.Prober{}
+	conn.avtags = make(chan avTag, streamQueueLen)
+	conn.done = make(chan struct{})
 	conn.netconn = netconn
+	conn.commands = make(map[string]CommandHandler)
+	conn.msgstreams = make(map[uint32]*Conn)
+	conn.endedsids = make(map[uint32]bool)
+	conn.calls = make(map[float64]chan *callResult)
+	conn.transid = 1
+	conn.ackwait = make(chan struct{})
+	conn.start = time.Now()
+	conn.closed = make(chan struct{})
 	conn.readcsmap = make(map[uint32]*chunkStream)
+	conn.writecsmap = make(map[uint32]*chunkStream)
 	conn.readMaxChunkSize = 128
 	conn.writeMaxChunkSize = 128
-	conn.bufr = bufio.NewReaderSize(netconn, buffersize)
-	conn.bufw = bufio.NewWriterSize(netconn, buffersize)
-	conn.txrxcount = &txrxcount{ReadWriter: netconn}
+	conn.chunkSize = DefaultChunkSize
+	conn.tconn = &timeoutConn{Conn: netconn}
+	conn.txrxcount = &txrxcount{ReadWriter: conn.tconn}
+	conn.bufr = bufio.NewReaderSize(conn.txrxcount, buffersize)
+	conn.bufw = bufio.NewWriterSize(conn.txrxcount, buffersize)
 	conn.writebuf = make([]byte, 4096)
 	conn.readbuf = make([]byte, 4096)
 	return conn
@@ -262,8 +890,12 @@ const (
 
 const (
 	eventtypeStreamBegin      = 0
+	eventtypeStreamEOF        = 1
+	eventtypeStreamDry        = 2
 	eventtypeSetBufferLength  = 3
 	eventtypeStreamIsRecorded = 4
+	eventtypePingRequest      = 6
+	eventtypePingResponse     = 7
 )
 
 func (self *Conn) NetConn() net.Conn {
@@ -271,13 +903,14 @@ func (self *Conn) NetConn() net.Conn {
 }
 
 func (self *Conn) TxBytes() uint64 {
-	return self.txrxcount.txbytes
+	return atomic.LoadUint64(&self.txrxcount.txbytes)
 }
 
 func (self *Conn) RxBytes() uint64 {
-	return self.txrxcount.rxbytes
+	return atomic.LoadUint64(&self.txrxcount.rxbytes)
 }
 
+// Close closes the connection, and so every stream on it.
 func (self *Conn) Close() (err error) {
 	return self.netconn.Close()
 }
@@ -293,17 +926,16 @@ func (self *Conn) pollCommand() (err error) {
 	}
 }
 
-func (self *Conn) pollAVTag() (tag flv.Tag, err error) {
-	for {
-		if err = self.pollMsg(); err != nil {
-			return
-		}
-		switch self.msgtypeid {
-		case msgtypeidVideoMsg, msgtypeidAudioMsg:
-			tag = self.avtag
-			return
-		}
+// pollAVTag returns the next tag the read loop queued for this stream.
+func (self *Conn) pollAVTag() (tag flv.Tag, timestamp uint32, err error) {
+	avtag, ok := <-self.avtags
+	if !ok {
+		err = self.closeerr
+		return
 	}
+	tag = avtag.tag
+	timestamp = avtag.timestamp
+	return
 }
 
 func (self *Conn) pollMsg() (err error) {
@@ -365,10 +997,55 @@ func createURL(tcurl, app, play string) (u *url.URL) {
 
 var CodecTypes = flv.CodecTypes
 
+// FourCcList is the enhanced rtmp codecs announced in connect.
+var FourCcList = []string{"hvc1", "av01", "vp09", "Opus"}
+
+func fourCcListAMF() flv.AMFArray {
+	list := flv.AMFArray{}
+	for _, fourcc := range FourCcList {
+		list = append(list, fourcc)
+	}
+	return list
+}
+
+func parseFourCcList(obj flv.AMFMap) (list []string) {
+	arr, ok := obj["fourCcList"].(flv.AMFArray)
+	if !ok {
+		return
+	}
+	list = []string{}
+	for _, v := range arr {
+		if s, ok := v.(string); ok {
+			list = append(list, s)
+		}
+	}
+	return
+}
+
+func fourCCString(fourcc uint32) string {
+	return string([]byte{byte(fourcc >> 24), byte(fourcc >> 16), byte(fourcc >> 8), byte(fourcc)})
+}
+
+// checkPeerFourCC fails if the peer announced a fourCcList without the
+// codec. Peers that announced nothing are assumed to accept anything.
+func (self *Conn) checkPeerFourCC(typ av.CodecType) (err error) {
+	fourcc := flv.CodecFourCC(typ)
+	if fourcc == 0 || self.peerFourCcList == nil {
+		return
+	}
+	name := fourCCString(fourcc)
+	for _, s := range self.peerFourCcList {
+		if s == name || s == "*" {
+			return
+		}
+	}
+	err = fmt.Errorf("rtmp: peer does not support codec %s", name)
+	return
+}
+
 func (self *Conn) writeBasicConf() (err error) {
 	// > SetChunkSize
-
-	if err = self.writeSetChunkSize(1024 * 1024 * 128); err != nil {
+	if err = self.writeSetChunkSize(self.chunkSize); err != nil {
 		return
 	}
 
@@ -377,7 +1054,7 @@ func (self *Conn) writeBasicConf() (err error) {
 		return
 	}
 	// > SetPeerBandwidth
-	if err = self.writeSetPeerBandwidth(5000000, 2); err != nil {
+	if err = self.writeSetPeerBandwidth(5000000, peerBandwidthDynamic); err != nil {
 		return
 	}
 	return
@@ -391,18 +1068,18 @@ func (self *Conn) readConnect() (err error) {
 		return
 	}
 	if self.commandname != "connect" {
-		err = fmt.Errorf("rtmp: first command is not connect")
+		err = protocolError("first command is not connect")
 		return
 	}
 	if self.commandobj == nil {
-		err = fmt.Errorf("rtmp: connect command params invalid")
+		err = protocolError("connect command params invalid")
 		return
 	}
 
 	var ok bool
 	var _app, _tcurl interface{}
 	if _app, ok = self.commandobj["app"]; !ok {
-		err = fmt.Errorf("rtmp: `connect` params missing `app`")
+		err = protocolError("`connect` params missing `app`")
 		return
 	}
 	connectpath, _ = _app.(string)
@@ -414,23 +1091,34 @@ func (self *Conn) readConnect() (err error) {
 	if ok {
 		tcurl, _ = _tcurl.(string)
 	}
-	connectparams := self.commandobj
+	self.tcurl = tcurl
+	self.connectpath = connectpath
+	self.connectparams = self.commandobj
+	self.peerFourCcList = parseFourCcList(self.commandobj)
+
+	// reply with the encoding the client asked for, AMF0 by default
+	objectEncoding, _ := self.commandobj["objectEncoding"].(float64)
 
 	if err = self.writeBasicConf(); err != nil {
 		return
 	}
 
+	properties := flv.AMFMap{
+		"fmtVer":       "FMS/3,0,1,123",
+		"capabilities": 31,
+	}
+	if self.peerFourCcList != nil {
+		properties["fourCcList"] = fourCcListAMF()
+	}
+
 	// > _result("NetConnection.Connect.Success")
 	if err = self.writeCommandMsg(3, 0, "_result", self.commandtransid,
-		flv.AMFMap{
-			"fmtVer":       "FMS/3,0,1,123",
-			"capabilities": 31,
-		},
+		properties,
 		flv.AMFMap{
 			"level":          "status",
 			"code":           "NetConnection.Connect.Success",
 			"description":    "Connection succeeded.",
-			"objectEncoding": 3,
+			"objectEncoding": objectEncoding,
 		},
 	); err != nil {
 		return
@@ -446,149 +1134,1020 @@ func (self *Conn) readConnect() (err error) {
 		}
 		if self.gotcommand {
 			switch self.commandname {
-
-			// < createStream
 			case "createStream":
-				self.avmsgsid = uint32(1)
-				// > _result(streamid)
-				if err = self.writeCommandMsg(3, 0, "_result", self.commandtransid, nil, self.avmsgsid); err != nil {
-					return
-				}
-				if err = self.flushWrite(); err != nil {
+				if err = self.replyCreateStream(); err != nil {
 					return
 				}
 
-			// < publish("path")
-			case "publish":
-				if Debug {
-					fmt.Println("rtmp: < publish")
-				}
+			case "publish", "play":
+				self.avmsgsid = self.commandStreamID()
+				return self.acceptStream()
 
-				if len(self.commandparams) < 1 {
-					err = fmt.Errorf("rtmp: publish params invalid")
+			default:
+				if err = self.handleCommand(); err != nil {
 					return
 				}
-				publishpath, _ := self.commandparams[0].(string)
-
-				var cberr error
-				if self.OnPlayOrPublish != nil {
-					cberr = self.OnPlayOrPublish(self.commandname, connectparams)
-				}
+			}
+		}
+	}
 
-				// > onStatus()
-				if err = self.writeCommandMsg(5, self.avmsgsid,
-					"onStatus", self.commandtransid, nil,
-					flv.AMFMap{
-						"level":       "status",
-						"code":        "NetStream.Publish.Start",
-						"description": "Start publishing",
-					},
-				); err != nil {
-					return
-				}
-				if err = self.flushWrite(); err != nil {
-					return
-				}
+	return
+}
 
-				if cberr != nil {
-					err = fmt.Errorf("rtmp: OnPlayOrPublish check failed")
-					return
-				}
+// < createStream
+func (self *Conn) replyCreateStream() (err error) {
+	self.lock.Lock()
+	self.nextsid++
+	msgsid := self.nextsid
+	self.lock.Unlock()
 
-				self.URL = createURL(tcurl, connectpath, publishpath)
-				self.publishing = true
-				self.reading = true
-				self.stage++
-				return
+	// > _result(streamid)
+	if err = self.writeCommandMsg(3, 0, "_result", self.commandtransid, nil, msgsid); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
 
-			// < play("path")
-			case "play":
-				if Debug {
-					fmt.Println("rtmp: < play")
-				}
+// commandStreamID returns the stream a publish or play was sent on, some
+// clients send it on stream 0 right after createStream.
+func (self *Conn) commandStreamID() uint32 {
+	if self.msgsid != 0 {
+		return self.msgsid
+	}
+	return self.nextsid
+}
 
-				if len(self.commandparams) < 1 {
-					err = fmt.Errorf("rtmp: command play params invalid")
-					return
-				}
-				playpath, _ := self.commandparams[0].(string)
+const (
+	// PlayLive plays only a live stream.
+	PlayLive = -1
+	// PlayLiveOrRecorded plays a live stream if there is one, else the
+	// recorded one.
+	PlayLiveOrRecorded = -2
+)
 
-				// > streamBegin(streamid)
-				if err = self.writeStreamBegin(self.avmsgsid); err != nil {
-					return
-				}
+// PlayOptions are the start, duration and reset arguments of play.
+type PlayOptions struct {
+	// Start is PlayLive, PlayLiveOrRecorded or the position in seconds
+	// to play a recorded stream from.
+	Start float64
+	// Duration is the seconds to play, -1 plays until the end.
+	Duration float64
+	// Reset flushes the playlist of the stream.
+	Reset bool
+}
+
+// DefaultPlayOptions are the play arguments of a player that sent none.
+var DefaultPlayOptions = PlayOptions{
+	Start:    PlayLiveOrRecorded,
+	Duration: -1,
+	Reset:    true,
+}
+
+// describe is the description of NetStream.Play.Start.
+func (self PlayOptions) describe(playpath string) string {
+	var s string
+	switch {
+	case self.Start == PlayLive:
+		s = "Started playing live " + playpath
+	case self.Start > 0:
+		s = fmt.Sprintf("Started playing %s from %gs", playpath, self.Start)
+	default:
+		s = "Started playing " + playpath
+	}
+	if self.Duration >= 0 {
+		s += fmt.Sprintf(" for %gs", self.Duration)
+	}
+	return s
+}
 
-				// > onStatus()
-				if err = self.writeCommandMsg(5, self.avmsgsid,
-					"onStatus", self.commandtransid, nil,
-					flv.AMFMap{
-						"level":       "status",
-						"code":        "NetStream.Play.Start",
-						"description": "Start live",
-					},
-				); err != nil {
-					return
-				}
+func parsePlayOptions(params []interface{}) (opts PlayOptions) {
+	opts = DefaultPlayOptions
+	if len(params) > 0 {
+		if start, ok := params[0].(float64); ok {
+			opts.Start = start
+		}
+	}
+	if len(params) > 1 {
+		if duration, ok := params[1].(float64); ok {
+			opts.Duration = duration
+		}
+	}
+	if len(params) > 2 {
+		// a number of flags in old players
+		switch reset := params[2].(type) {
+		case bool:
+			opts.Reset = reset
+		case float64:
+			opts.Reset = int(reset)&1 != 0
+		}
+	}
+	return
+}
 
-				// > |RtmpSampleAccess()
-				if err = self.writeDataMsg(5, self.avmsgsid,
-					"|RtmpSampleAccess", true, true,
-				); err != nil {
-					return
-				}
+// Play2Options are the NetStreamPlayOptions of play2.
+type Play2Options struct {
+	StreamName    string
+	OldStreamName string
+	Start         float64
+	Len           float64
+	Offset        float64
+	// Transition is "switch", "swap", "stop", "reset", "append" or
+	// "appendAndWait".
+	Transition string
+}
+
+func parsePlay2Options(obj flv.AMFMap) (opts Play2Options) {
+	opts.StreamName, _ = obj["streamName"].(string)
+	opts.OldStreamName, _ = obj["oldStreamName"].(string)
+	opts.Start, _ = obj["start"].(float64)
+	opts.Len, _ = obj["len"].(float64)
+	opts.Offset, _ = obj["offset"].(float64)
+	opts.Transition, _ = obj["transition"].(string)
+	return
+}
 
-				if err = self.flushWrite(); err != nil {
-					return
-				}
+func (self Play2Options) amf() flv.AMFMap {
+	obj := flv.AMFMap{
+		"streamName": self.StreamName,
+		"start":      self.Start,
+		"len":        self.Len,
+		"offset":     self.Offset,
+		"transition": self.Transition,
+	}
+	if self.OldStreamName != "" {
+		obj["oldStreamName"] = self.OldStreamName
+	}
+	return obj
+}
+
+// acceptStream answers the publish or play command for the stream. It
+// takes wlock for the reply only, OnPlayOrPublish runs before.
+func (self *Conn) acceptStream() (err error) {
+	switch self.commandname {
+
+	// < publish("path")
+	case "publish":
+		if self.tracing() {
+			self.log(LevelTrace, "< publish", "params", self.commandparams)
+		}
+
+		if len(self.commandparams) < 1 {
+			err = protocolError("publish params invalid")
+			return
+		}
+		publishpath, _ := self.commandparams[0].(string)
+
+		var cberr error
+		if self.OnPlayOrPublish != nil {
+			cberr = self.OnPlayOrPublish(self.commandname, self.connectparams)
+		}
+
+		self.wlock.Lock()
+		defer self.wlock.Unlock()
+
+		if cberr != nil {
+			err = self.refuseStream(cberr)
+			return
+		}
+
+		// > onStatus()
+		if err = self.writeCommandMsg(5, self.avmsgsid,
+			"onStatus", self.commandtransid, nil,
+			flv.AMFMap{
+				"level":       "status",
+				"code":        "NetStream.Publish.Start",
+				"description": "Start publishing",
+			},
+		); err != nil {
+			return
+		}
+		if err = self.flushWrite(); err != nil {
+			return
+		}
+
+		self.URL = createURL(self.tcurl, self.connectpath, publishpath)
+		self.publishing = true
+		self.reading = true
+
+	// < play("path")
+	case "play":
+		if self.tracing() {
+			self.log(LevelTrace, "< play", "params", self.commandparams)
+		}
+
+		if len(self.commandparams) < 1 {
+			err = protocolError("command play params invalid")
+			return
+		}
+		playpath, _ := self.commandparams[0].(string)
+		opts := parsePlayOptions(self.commandparams[1:])
 
-				self.URL = createURL(tcurl, connectpath, playpath)
-				self.playing = true
-				self.writing = true
-				self.stage++
+		self.wlock.Lock()
+		defer self.wlock.Unlock()
+
+		// > streamBegin(streamid)
+		if err = self.writeStreamBegin(self.avmsgsid); err != nil {
+			return
+		}
+
+		if opts.Reset {
+			// > onStatus()
+			if err = self.writeCommandMsg(5, self.avmsgsid,
+				"onStatus", self.commandtransid, nil,
+				flv.AMFMap{
+					"level":       "status",
+					"code":        "NetStream.Play.Reset",
+					"description": "Playing and resetting " + playpath,
+				},
+			); err != nil {
 				return
 			}
+		}
+
+		// > onStatus()
+		if err = self.writeCommandMsg(5, self.avmsgsid,
+			"onStatus", self.commandtransid, nil,
+			flv.AMFMap{
+				"level":       "status",
+				"code":        "NetStream.Play.Start",
+				"description": opts.describe(playpath),
+			},
+		); err != nil {
+			return
+		}
+
+		// > |RtmpSampleAccess()
+		if err = self.writeDataMsg(5, self.avmsgsid,
+			"|RtmpSampleAccess", true, true,
+		); err != nil {
+			return
+		}
 
+		if err = self.flushWrite(); err != nil {
+			return
 		}
+
+		self.URL = createURL(self.tcurl, self.connectpath, playpath)
+		self.PlayOptions = &opts
+		self.playing = true
+		self.writing = true
+	}
+
+	self.stage = stageCommandDone
+	return
+}
+
+// refuseStream answers the publish refused by OnPlayOrPublish with an error
+// onStatus, and returns it as a StatusError.
+func (self *Conn) refuseStream(cberr error) (err error) {
+	status := &StatusError{
+		Level:       "error",
+		Code:        CodePublishBadName,
+		Description: cberr.Error(),
+	}
+	if _status, ok := cberr.(*StatusError); ok {
+		*status = *_status
+		if status.Level == "" {
+			status.Level = "error"
+		}
+	}
+	status.Command = self.commandname
+	status.Info = flv.AMFMap{
+		"level":       status.Level,
+		"code":        status.Code,
+		"description": status.Description,
+	}
+
+	// > onStatus()
+	if err = self.writeCommandMsg(5, self.avmsgsid,
+		"onStatus", self.commandtransid, nil, status.Info,
+	); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	err = status
+	return
+}
+
+// newStream makes a stream view sharing the connection of self.
+func (self *Conn) newStream(msgsid uint32) *Conn {
+	return &Conn{
+		OnPlayOrPublish: self.OnPlayOrPublish,
+		OnPlay2:         self.OnPlay2,
+		session:         self.session,
+		prober:          &flv.Prober{},
+		avmsgsid:        msgsid,
+		avtags:          make(chan avTag, streamQueueLen),
+		done:            make(chan struct{}),
+	}
+}
+
+func (self *Conn) addStream(stream *Conn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.readerr != nil {
+		stream.closeerr = self.readerr
+		close(stream.avtags)
+		return
 	}
+	self.msgstreams[stream.avmsgsid] = stream
+	delete(self.endedsids, stream.avmsgsid)
+}
+
+// detach stops queueing packets for the stream, the connection and the
+// other streams keep going.
+func (self *Conn) detach() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.msgstreams[self.avmsgsid] == self {
+		delete(self.msgstreams, self.avmsgsid)
+		close(self.done)
+	}
+}
 
+func (self *Conn) lookupStream(msgsid uint32) (stream *Conn) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if stream = self.msgstreams[msgsid]; stream != nil || self.endedsids[msgsid] {
+		return
+	}
+	// some peers send media on another msgsid than the one created, that
+	// is fine as long as there is one stream to deliver to
+	if len(self.msgstreams) == 1 {
+		for _, s := range self.msgstreams {
+			stream = s
+		}
+	}
 	return
 }
 
-func (self *Conn) checkConnectResult() (ok bool, errmsg string) {
-	if len(self.commandparams) < 1 {
-		errmsg = "params length < 1"
+// readLoop reads the connection once the first stream is set up. It hands
+// audio and video to the stream they belong to and answers the commands
+// that open more streams.
+func (self *Conn) readLoop() {
+	if self.isserver && self.pingInterval > 0 {
+		go self.pingLoop()
+	}
+
+	var err error
+	for {
+		if err = self.pollMsg(); err != nil {
+			break
+		}
+		if self.gotcommand {
+			if err = self.handleCommand(); err != nil {
+				break
+			}
+			continue
+		}
+		switch self.msgtypeid {
+		case msgtypeidVideoMsg, msgtypeidAudioMsg:
+			stream := self.lookupStream(self.msgsid)
+			if stream == nil || !stream.reading {
+				continue
+			}
+			self.queueAVTag(stream)
+		}
+	}
+
+	self.log(LevelDebug, "read loop stopped", "err", err)
+
+	self.lock.Lock()
+	self.readerr = err
+	for _, stream := range self.msgstreams {
+		stream.closeerr = err
+		// the peer went away without deleteStream
+		if err == io.EOF && stream.isserver && stream.publishing {
+			stream.closeerr = io.ErrUnexpectedEOF
+		}
+		close(stream.avtags)
+	}
+	self.lock.Unlock()
+	close(self.closed)
+}
+
+// queueAVTag hands the current audio or video to stream. A stream that
+// shares the connection and falls streamQueueLen packets behind ends with
+// ErrStreamQueueFull, the read loop must go on for the other streams, their
+// commands and the Acks. A stream alone on its connection holds the read
+// loop back instead.
+func (self *Conn) queueAVTag(stream *Conn) {
+	avtag := avTag{tag: self.avtag, timestamp: self.timestamp}
+	select {
+	case stream.avtags <- avtag:
+		return
+	case <-stream.done:
+		return
+	default:
+	}
+
+	self.lock.Lock()
+	shared := len(self.msgstreams) > 1
+	self.lock.Unlock()
+	if shared {
+		self.log(LevelWarn, "stream queue full", "msgsid", stream.avmsgsid)
+		self.endStream(stream, ErrStreamQueueFull)
 		return
 	}
+	select {
+	case stream.avtags <- avtag:
+	case <-stream.done:
+	}
+}
 
-	obj, _ := self.commandparams[0].(flv.AMFMap)
-	if obj == nil {
-		errmsg = "params[0] not object"
+// endStream takes stream off the connection, its ReadPacket returns err
+// once the queued packets are read and WritePacket fails. It runs on the
+// read loop, the only sender on avtags.
+func (self *Conn) endStream(stream *Conn, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.msgstreams[stream.avmsgsid] != stream {
 		return
 	}
+	delete(self.msgstreams, stream.avmsgsid)
+	self.endedsids[stream.avmsgsid] = true
+	stream.closeerr = err
+	close(stream.avtags)
+	close(stream.done)
+}
+
+func (self *Conn) handleCommand() (err error) {
+	switch self.commandname {
+	case "_result", "_error":
+		self.lock.Lock()
+		done := self.calls[self.commandtransid]
+		delete(self.calls, self.commandtransid)
+		self.lock.Unlock()
+		if done != nil {
+			done <- &callResult{
+				name:   self.commandname,
+				obj:    self.commandobj,
+				params: self.commandparams,
+			}
+		}
+
+	case "createStream":
+		if !self.isserver {
+			return
+		}
+		self.wlock.Lock()
+		err = self.replyCreateStream()
+		self.wlock.Unlock()
+
+	case "publish", "play":
+		if !self.isserver {
+			return
+		}
+		msgsid := self.commandStreamID()
+		self.lock.Lock()
+		_, exists := self.msgstreams[msgsid]
+		self.lock.Unlock()
+		if exists {
+			return
+		}
+
+		stream := self.newStream(msgsid)
+		err = stream.acceptStream()
+		if err != nil {
+			// a refused stream leaves the connection to the others
+			if _, ok := err.(*StatusError); ok {
+				self.log(LevelInfo, "stream refused", "err", err)
+				err = nil
+			}
+			return
+		}
+		self.addStream(stream)
+		if self.onStream != nil {
+			self.onStream(stream)
+		}
+
+	case "play2":
+		if !self.isserver {
+			return
+		}
+		err = self.replyPlay2()
+
+	case "pause", "pauseRaw", "seek":
+		if !self.isserver {
+			return
+		}
+		err = self.handleVodCommand()
+
+	case "releaseStream", "FCPublish", "FCUnpublish":
+		if !self.isserver {
+			return
+		}
+		err = self.replyFCCommand()
+
+	case "deleteStream", "closeStream":
+		if !self.isserver {
+			return
+		}
+		err = self.deleteStream()
+
+	case "onStatus":
+		if !self.isserver {
+			self.handleStatus()
+		}
+		err = self.dispatchCommand()
+
+	default:
+		err = self.dispatchCommand()
+	}
+	return
+}
+
+// < onStatus()
+//
+// An error status ends the stream it is for, its ReadPacket and WritePacket
+// return the StatusError.
+func (self *Conn) handleStatus() {
+	command := "play"
+	self.lock.Lock()
+	stream := self.msgstreams[self.msgsid]
+	if stream != nil && stream.publishing {
+		command = "publish"
+	}
+	self.lock.Unlock()
 
-	_code, _ := obj["code"]
-	if _code == nil {
-		errmsg = "code invalid"
+	status := newStatusError(command, self.commandparams)
+	if status.Level != "error" {
 		return
 	}
+	self.log(LevelInfo, "stream failed", "msgsid", self.msgsid, "code", status.Code, "description", status.Description)
+
+	if stream != nil {
+		self.endStream(stream, status)
+	}
+}
 
-	code, _ := _code.(string)
-	if code != "NetConnection.Connect.Success" {
-		errmsg = "code != NetConnection.Connect.Success"
+// < play2(options)
+func (self *Conn) replyPlay2() (err error) {
+	self.lock.Lock()
+	stream := self.msgstreams[self.msgsid]
+	self.lock.Unlock()
+	if stream == nil || !stream.playing {
 		return
 	}
 
-	ok = true
+	var opts Play2Options
+	if len(self.commandparams) > 0 {
+		if obj, ok := self.commandparams[0].(flv.AMFMap); ok {
+			opts = parsePlay2Options(obj)
+		}
+	}
+
+	if self.tracing() {
+		self.log(LevelTrace, "< play2", "name", opts.StreamName, "transition", opts.Transition)
+	}
+
+	status := flv.AMFMap{
+		"level":       "status",
+		"code":        "NetStream.Play.Transition",
+		"description": "Transitioning to " + opts.StreamName,
+		"details":     opts.StreamName,
+		"reason":      opts.Transition,
+	}
+	if stream.OnPlay2 == nil {
+		status = flv.AMFMap{
+			"level":       "error",
+			"code":        "NetStream.Play.Failed",
+			"description": "play2 not supported",
+			"details":     opts.StreamName,
+		}
+	} else if cberr := stream.OnPlay2(stream, opts); cberr != nil {
+		status = flv.AMFMap{
+			"level":       "error",
+			"code":        "NetStream.Play.Failed",
+			"description": cberr.Error(),
+			"details":     opts.StreamName,
+		}
+	} else {
+		stream.restartPlayDuration()
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	// > onStatus()
+	if err = self.writeCommandMsg(5, self.msgsid, "onStatus", 0, nil, status); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
 	return
 }
 
-func (self *Conn) checkCreateStreamResult() (ok bool, avmsgsid uint32) {
-	if len(self.commandparams) < 1 {
+// Play2 asks the server to switch the playing stream, it returns once the
+// request is sent. The server answers with NetStream.Play.Transition.
+func (self *Conn) Play2(opts Play2Options) (err error) {
+	if self.isserver || !self.playing || self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: Play2 needs a playing client")
 		return
 	}
 
-	ok = true
-	_avmsgsid, _ := self.commandparams[0].(float64)
+	// > play2(options)
+	if self.tracing() {
+		self.log(LevelTrace, "> play2", "name", opts.StreamName, "transition", opts.Transition)
+	}
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err = self.writeCommandMsg(8, self.avmsgsid, "play2", 0, nil, opts.amf()); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+// playArgs returns the arguments of play for path.
+func (self *Conn) playArgs(path string) (args []interface{}) {
+	args = []interface{}{"play", 0, nil, path}
+	if opts := self.PlayOptions; opts != nil {
+		args = append(args, opts.Start, opts.Duration, opts.Reset)
+	}
+	return
+}
+
+// < releaseStream("path"), FCPublish("path"), FCUnpublish("path")
+func (self *Conn) replyFCCommand() (err error) {
+	var name string
+	if len(self.commandparams) > 0 {
+		name, _ = self.commandparams[0].(string)
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	switch self.commandname {
+	case "FCPublish":
+		// > onFCPublish()
+		if err = self.writeCommandMsg(3, 0, "onFCPublish", 0, nil,
+			flv.AMFMap{
+				"code":        "NetStream.Publish.Start",
+				"description": name,
+			},
+		); err != nil {
+			return
+		}
+
+	case "FCUnpublish":
+		// > onFCUnpublish()
+		if err = self.writeCommandMsg(3, 0, "onFCUnpublish", 0, nil,
+			flv.AMFMap{
+				"code":        "NetStream.Unpublish.Success",
+				"description": name,
+			},
+		); err != nil {
+			return
+		}
+	}
+
+	if self.commandtransid != 0 {
+		// > _result()
+		if err = self.writeCommandMsg(3, 0, "_result", self.commandtransid, nil); err != nil {
+			return
+		}
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+// < deleteStream(streamid), closeStream()
+//
+// The stream ends cleanly, ReadPacket returns io.EOF once the queued
+// packets are read.
+func (self *Conn) deleteStream() (err error) {
+	msgsid := self.msgsid
+	if self.commandname == "deleteStream" {
+		if len(self.commandparams) < 1 {
+			err = protocolError("deleteStream params invalid")
+			return
+		}
+		_msgsid, _ := self.commandparams[0].(float64)
+		msgsid = uint32(_msgsid)
+	}
+
+	self.lock.Lock()
+	stream := self.msgstreams[msgsid]
+	self.lock.Unlock()
+	if stream != nil {
+		self.endStream(stream, io.EOF)
+	}
+
+	if stream == nil || !stream.publishing {
+		return
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	// > onStatus()
+	if err = self.writeCommandMsg(5, msgsid,
+		"onStatus", 0, nil,
+		flv.AMFMap{
+			"level":       "status",
+			"code":        "NetStream.Unpublish.Success",
+			"description": "Stop publishing",
+		},
+	); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+// Unpublish ends a publishing stream with FCUnpublish and deleteStream,
+// the connection stays open for the other streams.
+func (self *Conn) Unpublish() (err error) {
+	if self.isserver || !self.publishing || self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: Unpublish needs a publishing client")
+		return
+	}
+	if self.isClosed() {
+		return
+	}
+
+	_, name := SplitPath(self.URL)
+
+	self.lock.Lock()
+	transid := self.transid
+	self.transid += 2
+	self.lock.Unlock()
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	// > FCUnpublish('path')
+	if self.tracing() {
+		self.log(LevelTrace, "> FCUnpublish", "name", name)
+	}
+	if err = self.writeCommandMsg(3, 0, "FCUnpublish", transid, nil, name); err != nil {
+		return
+	}
+	// > deleteStream(streamid)
+	if err = self.writeCommandMsg(3, 0, "deleteStream", transid+1, nil, self.avmsgsid); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+
+	self.detach()
+	return
+}
+
+func (self *Conn) isClosed() bool {
+	select {
+	case <-self.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// closedError is the error of writing to a closed stream, the StatusError
+// of the peer when that closed it.
+func (self *Conn) closedError() error {
+	if status, ok := self.closeerr.(*StatusError); ok {
+		return status
+	}
+	return fmt.Errorf("rtmp: stream %d closed", self.avmsgsid)
+}
+
+// HandleCommand registers the handler for the command name on the
+// connection of self, it replaces the one registered on the Server.
+func (self *Conn) HandleCommand(name string, handler CommandHandler) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.commands[name] = handler
+}
+
+// dispatchCommand runs the registered handler of the current command and
+// sends its reply. Commands without a handler are ignored.
+func (self *Conn) dispatchCommand() (err error) {
+	self.lock.Lock()
+	handler := self.commands[self.commandname]
+	stream := self.msgstreams[self.msgsid]
+	self.lock.Unlock()
+
+	if handler == nil {
+		self.log(LevelDebug, "command ignored", "command", self.commandname)
+		return
+	}
+	if stream == nil {
+		stream = self
+	}
+
+	transid := self.commandtransid
+	result, cberr := handler(stream, transid, self.commandobj, self.commandparams)
+	if transid == 0 {
+		return
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if cberr != nil {
+		// > _error()
+		err = self.writeCommandMsg(3, self.msgsid, "_error", transid, nil,
+			flv.AMFMap{
+				"level":       "error",
+				"code":        "NetConnection.Call.Failed",
+				"description": cberr.Error(),
+			},
+		)
+	} else {
+		// > _result()
+		err = self.writeCommandMsg(3, self.msgsid, append([]interface{}{"_result", transid, nil}, result...)...)
+	}
+	if err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+// Call invokes the command name on the peer with args, and waits for the
+// reply. It returns the values of _result after the command object, an
+// _error reply is returned as a StatusError. The connection must be set
+// up, see Prepare.
+func (self *Conn) Call(name string, args ...interface{}) (result []interface{}, err error) {
+	if self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: call %s before the connection is set up", name)
+		return
+	}
+
+	var res *callResult
+	if res, err = self.call(name, args...); err != nil {
+		return
+	}
+	result = res.params
+	return
+}
+
+// call sends a command on stream 0 and waits for its _result or _error.
+func (self *Conn) call(name string, args ...interface{}) (res *callResult, err error) {
+	done := make(chan *callResult, 1)
+
+	self.lock.Lock()
+	if self.readerr != nil {
+		err = self.readerr
+		self.lock.Unlock()
+		return
+	}
+	transid := self.transid
+	self.transid++
+	self.calls[transid] = done
+	self.lock.Unlock()
+
+	self.wlock.Lock()
+	if err = self.writeCommandMsg(3, 0, append([]interface{}{name, transid, nil}, args...)...); err == nil {
+		err = self.flushWrite()
+	}
+	self.wlock.Unlock()
+	if err != nil {
+		self.lock.Lock()
+		delete(self.calls, transid)
+		self.lock.Unlock()
+		return
+	}
+
+	select {
+	case res = <-done:
+	case <-self.closed:
+		err = self.readerr
+		return
+	}
+	if res.name == "_error" {
+		err = newStatusError(name, res.params)
+		return
+	}
+	return
+}
+
+func (self *Conn) createStream() (msgsid uint32, err error) {
+	var res *callResult
+	if res, err = self.call("createStream"); err != nil {
+		return
+	}
+	return self.checkCreateStreamResult(res.name, res.params)
+}
+
+// Publish opens a new stream on the connection of self and publishes path
+// on it. self must be connected already.
+func (self *Conn) Publish(path string) (stream *Conn, err error) {
+	if self.isserver || self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: Publish needs a connected client")
+		return
+	}
+
+	var msgsid uint32
+	if msgsid, err = self.createStream(); err != nil {
+		return
+	}
+
+	stream = self.newStream(msgsid)
+	stream.URL = createURL(getTcUrl(self.URL), self.connectpath, path)
+
+	// > publish('path')
+	if self.tracing() {
+		self.log(LevelTrace, "> publish", "name", path)
+	}
+	self.wlock.Lock()
+	if err = self.writeCommandMsg(8, msgsid, "publish", 0, nil, path); err == nil {
+		err = self.flushWrite()
+	}
+	self.wlock.Unlock()
+	if err != nil {
+		return
+	}
+
+	stream.writing = true
+	stream.publishing = true
+	stream.stage = stageCommandDone
+	self.addStream(stream)
+	return
+}
+
+// Play opens a new stream on the connection of self and plays path on it.
+// self must be connected already.
+func (self *Conn) Play(path string) (stream *Conn, err error) {
+	return self.PlayWithOptions(path, nil)
+}
+
+// PlayWithOptions is Play with the start, duration and reset arguments.
+func (self *Conn) PlayWithOptions(path string, opts *PlayOptions) (stream *Conn, err error) {
+	if self.isserver || self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: Play needs a connected client")
+		return
+	}
+
+	var msgsid uint32
+	if msgsid, err = self.createStream(); err != nil {
+		return
+	}
+
+	stream = self.newStream(msgsid)
+	stream.URL = createURL(getTcUrl(self.URL), self.connectpath, path)
+	stream.PlayOptions = opts
+	stream.reading = true
+	stream.playing = true
+	stream.stage = stageCommandDone
+	self.addStream(stream)
+
+	// > SetBufferLength
+	// > play('path')
+	if self.tracing() {
+		self.log(LevelTrace, "> play", "name", path)
+	}
+	self.wlock.Lock()
+	if err = self.writeSetBufferLength(msgsid, 100); err == nil {
+		if err = self.writeCommandMsg(8, msgsid, stream.playArgs(path)...); err == nil {
+			err = self.flushWrite()
+		}
+	}
+	self.wlock.Unlock()
+	return
+}
+
+// checkConnectResult returns the StatusError of a refused connect.
+func (self *Conn) checkConnectResult() (err error) {
+	status := newStatusError("connect", self.commandparams)
+	if status.Info == nil {
+		err = protocolError("connect %s params invalid", self.commandname)
+		return
+	}
+	if self.commandname == "_error" || status.Code != CodeConnectSuccess {
+		err = status
+		return
+	}
+	return
+}
+
+// checkCreateStreamResult reads the stream id of the reply to createStream.
+func (self *Conn) checkCreateStreamResult(name string, params []interface{}) (avmsgsid uint32, err error) {
+	if name == "_error" {
+		err = newStatusError("createStream", params)
+		return
+	}
+	if len(params) < 1 {
+		err = protocolError("createStream _result params invalid")
+		return
+	}
+	_avmsgsid, _ := params[0].(float64)
 	avmsgsid = uint32(_avmsgsid)
 	return
 }
@@ -596,10 +2155,11 @@ func (self *Conn) checkCreateStreamResult() (ok bool, avmsgsid uint32) {
 func (self *Conn) probe() (err error) {
 	for !self.prober.Probed() {
 		var tag flv.Tag
-		if tag, err = self.pollAVTag(); err != nil {
+		var timestamp uint32
+		if tag, timestamp, err = self.pollAVTag(); err != nil {
 			return
 		}
-		if err = self.prober.PushTag(tag, int32(self.timestamp)); err != nil {
+		if err = self.prober.PushTag(tag, int32(timestamp)); err != nil {
 			return
 		}
 	}
@@ -610,13 +2170,15 @@ func (self *Conn) probe() (err error) {
 }
 
 func (self *Conn) writeConnect(path string) (err error) {
+	self.connectpath = path
+
 	if err = self.writeBasicConf(); err != nil {
 		return
 	}
 
 	// > connect("app")
-	if Debug {
-		fmt.Printf("rtmp: > connect('%s') host=%s\n", path, self.URL.Host)
+	if self.tracing() {
+		self.log(LevelTrace, "> connect", "app", path, "host", self.URL.Host)
 	}
 	if err = self.writeCommandMsg(3, 0, "connect", 1,
 		flv.AMFMap{
@@ -628,6 +2190,7 @@ func (self *Conn) writeConnect(path string) (err error) {
 			"audioCodecs":   4071,
 			"videoCodecs":   252,
 			"videoFunction": 1,
+			"fourCcList":    fourCcListAMF(),
 		},
 	); err != nil {
 		return
@@ -643,26 +2206,21 @@ func (self *Conn) writeConnect(path string) (err error) {
 		}
 		if self.gotcommand {
 			// < _result("NetConnection.Connect.Success")
-			if self.commandname == "_result" {
-				var ok bool
-				var errmsg string
-				if ok, errmsg = self.checkConnectResult(); !ok {
-					err = fmt.Errorf("rtmp: command connect failed: %s", errmsg)
+			// < _error("NetConnection.Connect.Rejected")
+			if self.commandname == "_result" || self.commandname == "_error" {
+				if err = self.checkConnectResult(); err != nil {
 					return
 				}
-				if Debug {
-					fmt.Printf("rtmp: < _result() of connect\n")
+				if self.commandobj != nil {
+					self.peerFourCcList = parseFourCcList(self.commandobj)
+				}
+				if self.tracing() {
+					self.log(LevelTrace, "< _result of connect", "obj", self.commandobj)
 				}
 				break
 			}
-		} else {
-			if self.msgtypeid == msgtypeidWindowAckSize {
-				if len(self.msgdata) == 4 {
-					self.readAckSize = pio.U32BE(self.msgdata)
-				}
-				if err = self.writeWindowAckSize(0xffffffff); err != nil {
-					return
-				}
+			if err = self.dispatchCommand(); err != nil {
+				return
 			}
 		}
 	}
@@ -670,23 +2228,27 @@ func (self *Conn) writeConnect(path string) (err error) {
 	return
 }
 
-func (self *Conn) connectPublish() (err error) {
-	connectpath, publishpath := SplitPath(self.URL)
+// connectStream sends connect and createStream, publish or play is left
+// to open the stream.
+func (self *Conn) connectStream() (err error) {
+	if self.streamCreated {
+		return
+	}
+
+	connectpath, _ := SplitPath(self.URL)
 
 	if err = self.writeConnect(connectpath); err != nil {
 		return
 	}
 
-	transid := 2
-
 	// > createStream()
-	if Debug {
-		fmt.Printf("rtmp: > createStream()\n")
+	if self.tracing() {
+		self.log(LevelTrace, "> createStream")
 	}
-	if err = self.writeCommandMsg(3, 0, "createStream", transid, nil); err != nil {
+	if err = self.writeCommandMsg(3, 0, "createStream", 2, nil); err != nil {
 		return
 	}
-	transid++
+	self.transid = 3
 
 	if err = self.flushWrite(); err != nil {
 		return
@@ -698,82 +2260,65 @@ func (self *Conn) connectPublish() (err error) {
 		}
 		if self.gotcommand {
 			// < _result(avmsgsid) of createStream
-			if self.commandname == "_result" {
-				var ok bool
-				if ok, self.avmsgsid = self.checkCreateStreamResult(); !ok {
-					err = fmt.Errorf("rtmp: createStream command failed")
+			if self.commandname == "_result" || self.commandname == "_error" {
+				if self.avmsgsid, err = self.checkCreateStreamResult(self.commandname, self.commandparams); err != nil {
 					return
 				}
 				break
 			}
+			if err = self.dispatchCommand(); err != nil {
+				return
+			}
 		}
 	}
 
-	// > publish('app')
-	if Debug {
-		fmt.Printf("rtmp: > publish('%s')\n", publishpath)
-	}
-	if err = self.writeCommandMsg(8, self.avmsgsid, "publish", transid, nil, publishpath); err != nil {
-		return
-	}
-	transid++
-
-	if err = self.flushWrite(); err != nil {
-		return
-	}
-
-	self.writing = true
-	self.publishing = true
-	self.stage++
+	self.streamCreated = true
 	return
 }
 
-func (self *Conn) connectPlay() (err error) {
-	connectpath, playpath := SplitPath(self.URL)
+func (self *Conn) connectPublish() (err error) {
+	_, publishpath := SplitPath(self.URL)
 
-	if err = self.writeConnect(connectpath); err != nil {
+	if err = self.connectStream(); err != nil {
 		return
 	}
 
-	// > createStream()
-	if Debug {
-		fmt.Printf("rtmp: > createStream()\n")
+	// > publish('app')
+	if self.tracing() {
+		self.log(LevelTrace, "> publish", "name", publishpath)
 	}
-	if err = self.writeCommandMsg(3, 0, "createStream", 2, nil); err != nil {
+	if err = self.writeCommandMsg(8, self.avmsgsid, "publish", self.transid, nil, publishpath); err != nil {
 		return
 	}
+	self.transid++
 
-	// > SetBufferLength 0,100ms
-	if err = self.writeSetBufferLength(0, 100); err != nil {
+	if err = self.flushWrite(); err != nil {
 		return
 	}
 
-	if err = self.flushWrite(); err != nil {
+	self.writing = true
+	self.publishing = true
+	self.stage++
+	return
+}
+
+func (self *Conn) connectPlay() (err error) {
+	_, playpath := SplitPath(self.URL)
+
+	if err = self.connectStream(); err != nil {
 		return
 	}
 
-	for {
-		if err = self.pollMsg(); err != nil {
-			return
-		}
-		if self.gotcommand {
-			// < _result(avmsgsid) of createStream
-			if self.commandname == "_result" {
-				var ok bool
-				if ok, self.avmsgsid = self.checkCreateStreamResult(); !ok {
-					err = fmt.Errorf("rtmp: createStream command failed")
-					return
-				}
-				break
-			}
-		}
+	// > SetBufferLength 100ms
+	if err = self.writeSetBufferLength(self.avmsgsid, 100); err != nil {
+		return
 	}
 
 	// > play('app')
-	if Debug {
-		fmt.Printf("rtmp: > play('%s')\n", playpath)
+	if self.tracing() {
+		self.log(LevelTrace, "> play", "name", playpath)
 	}
-	if err = self.writeCommandMsg(8, self.avmsgsid, "play", 0, nil, playpath); err != nil {
+	if err = self.writeCommandMsg(8, self.avmsgsid, self.playArgs(playpath)...); err != nil {
 		return
 	}
 	if err = self.flushWrite(); err != nil {
@@ -786,6 +2331,8 @@ func (self *Conn) connectPlay() (err error) {
 	return
 }
 
+// ReadPacket returns io.EOF when the peer deleted the stream, and
+// io.ErrUnexpectedEOF when the connection closed in the middle of a publish.
 func (self *Conn) ReadPacket() (pkt av.Packet, err error) {
 	if err = self.prepare(stageCodecDataDone, prepareReading); err != nil {
 		return
@@ -793,17 +2340,20 @@ func (self *Conn) ReadPacket() (pkt av.Packet, err error) {
 
 	if !self.prober.Empty() {
 		pkt = self.prober.PopPacket()
+		self.countPacket(pkt)
 		return
 	}
 
 	for {
 		var tag flv.Tag
-		if tag, err = self.pollAVTag(); err != nil {
+		var timestamp uint32
+		if tag, timestamp, err = self.pollAVTag(); err != nil {
 			return
 		}
 
 		var ok bool
-		if pkt, ok = self.prober.TagToPacket(tag, int32(self.timestamp)); ok {
+		if pkt, ok = self.prober.TagToPacket(tag, int32(timestamp)); ok {
+			self.countPacket(pkt)
 			return
 		}
 	}
@@ -819,32 +2369,40 @@ func (self *Conn) prepare(stage int, flags int) (err error) {
 	for self.stage < stage {
 		switch self.stage {
 		case 0:
+			timeout := self.Timeouts().Handshake
+			self.setPhaseDeadline(timeout)
 			if self.isserver {
-				if err = self.handshakeServer(); err != nil {
-					return
-				}
+				err = self.handshakeServer()
 			} else {
-				if err = self.handshakeClient(); err != nil {
-					return
+				err = self.handshakeClient()
+			}
+			if err = self.endPhase(err, "handshake", timeout); err != nil {
+				switch err.(type) {
+				case *HandshakeError, *TimeoutError:
+				default:
+					err = &HandshakeError{Msg: "failed", Err: err}
 				}
+				return
 			}
 
 		case stageHandshakeDone:
+			timeout := self.Timeouts().Command
+			self.setPhaseDeadline(timeout)
 			if self.isserver {
-				if err = self.readConnect(); err != nil {
-					return
-				}
+				err = self.readConnect()
 			} else {
 				if flags == prepareReading {
-					if err = self.connectPlay(); err != nil {
-						return
-					}
+					err = self.connectPlay()
 				} else {
-					if err = self.connectPublish(); err != nil {
-						return
-					}
+					err = self.connectPublish()
 				}
 			}
+			if err = self.endPhase(err, "command", timeout); err != nil {
+				return
+			}
+			self.addStream(self)
+			self.tconn.start()
+			go self.readLoop()
 
 		case stageCommandDone:
 			if flags == prepareReading {
@@ -872,22 +2430,101 @@ func (self *Conn) WritePacket(pkt av.Packet) (err error) {
 	if err = self.prepare(stageCodecDataDone, prepareWriting); err != nil {
 		return
 	}
+	if self.isClosed() {
+		err = self.closedError()
+		return
+	}
+	if self.playdone {
+		err = io.EOF
+		return
+	}
+	if self.isserver && self.playing {
+		if err = self.checkPlayDuration(pkt.Time); err != nil {
+			return
+		}
+	}
+
+	if err = self.waitWindow(); err != nil {
+		return
+	}
 
 	stream := self.streams[pkt.Idx]
 	tag, timestamp := flv.PacketToTag(pkt, stream)
 
-	if Debug {
-		fmt.Println("rtmp: WritePacket", pkt.Idx, pkt.Time, pkt.CompositionTime)
+	if self.tracing() {
+		self.log(LevelTrace, "WritePacket", "idx", pkt.Idx, "time", pkt.Time, "cts", pkt.CompositionTime)
 	}
 
 	if err = self.writeAVTag(tag, int32(timestamp)); err != nil {
 		return
 	}
+	self.countPacket(pkt)
+
+	return
+}
+
+// restartPlayDuration counts the play duration again from the next packet,
+// after the source was seeked or switched.
+func (self *Conn) restartPlayDuration() {
+	self.lock.Lock()
+	self.playstarted = false
+	self.lock.Unlock()
+}
+
+// checkPlayDuration ends a duration bounded play with NetStream.Play.Stop,
+// WritePacket returns io.EOF from then on.
+func (self *Conn) checkPlayDuration(pkttime time.Duration) (err error) {
+	self.lock.Lock()
+	started := self.playstarted
+	if !started {
+		self.playstart = pkttime
+		self.playstarted = true
+	}
+	playstart := self.playstart
+	self.lock.Unlock()
+	if !started {
+		return
+	}
+
+	opts := self.PlayOptions
+	if opts == nil || opts.Duration < 0 {
+		return
+	}
+	if float64(pkttime-playstart) < opts.Duration*float64(time.Second) {
+		return
+	}
 
+	self.playdone = true
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	// > onStatus()
+	if err = self.writeCommandMsg(5, self.avmsgsid,
+		"onStatus", 0, nil,
+		flv.AMFMap{
+			"level":       "status",
+			"code":        "NetStream.Play.Stop",
+			"description": "Stopped playing",
+		},
+	); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	err = io.EOF
 	return
 }
 
+// WriteTrailer flushes the stream, a client publisher also unpublishes it.
 func (self *Conn) WriteTrailer() (err error) {
+	if !self.isserver && self.publishing && self.stage >= stageCommandDone {
+		return self.Unpublish()
+	}
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
 	if err = self.flushWrite(); err != nil {
 		return
 	}
@@ -899,13 +2536,22 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 		return
 	}
 
+	for _, stream := range streams {
+		if err = self.checkPeerFourCC(stream.Type()); err != nil {
+			return
+		}
+	}
+
 	var metadata flv.AMFMap
 	if metadata, err = flv.NewMetadataByStreams(streams); err != nil {
 		return
 	}
 
 	// > onMetaData()
-	if err = self.writeDataMsg(5, self.avmsgsid, "onMetaData", metadata); err != nil {
+	self.wlock.Lock()
+	err = self.writeDataMsg(5, self.avmsgsid, "onMetaData", metadata)
+	self.wlock.Unlock()
+	if err != nil {
 		return
 	}
 
@@ -932,48 +2578,41 @@ func (self *Conn) WriteHeader(streams []av.CodecData) (err error) {
 func (self *Conn) tmpwbuf(n int) []byte {
 	if len(self.writebuf) < n {
 		self.writebuf = make([]byte, n)
-		fmt.Println("write buf ==== ", n)
 	}
 	return self.writebuf
 }
 
 func (self *Conn) writeSetChunkSize(size int) (err error) {
+	b := self.tmpwbuf(4)
+	pio.PutU32BE(b, uint32(size))
+	if err = self.writeMsg(false, 2, 0, msgtypeidSetChunkSize, 0, b[:4]); err != nil {
+		return
+	}
 	self.writeMaxChunkSize = size
-	b := self.tmpwbuf(chunkHeaderLength + 4)
-	n := self.fillChunkHeader(b, 2, 0, msgtypeidSetChunkSize, 0, 4)
-	pio.PutU32BE(b[n:], uint32(size))
-	n += 4
-	_, err = self.bufw.Write(b[:n])
 	return
 }
 
 func (self *Conn) writeAck(seqnum uint32) (err error) {
-	b := self.tmpwbuf(chunkHeaderLength + 4)
-	n := self.fillChunkHeader(b, 2, 0, msgtypeidAck, 0, 4)
-	pio.PutU32BE(b[n:], seqnum)
-	n += 4
-	_, err = self.bufw.Write(b[:n])
-	return
+	b := self.tmpwbuf(4)
+	pio.PutU32BE(b, seqnum)
+	return self.writeMsg(false, 2, 0, msgtypeidAck, 0, b[:4])
 }
 
 func (self *Conn) writeWindowAckSize(size uint32) (err error) {
-	b := self.tmpwbuf(chunkHeaderLength + 4)
-	n := self.fillChunkHeader(b, 2, 0, msgtypeidWindowAckSize, 0, 4)
-	pio.PutU32BE(b[n:], size)
-	n += 4
-	_, err = self.bufw.Write(b[:n])
+	b := self.tmpwbuf(4)
+	pio.PutU32BE(b, size)
+	if err = self.writeMsg(false, 2, 0, msgtypeidWindowAckSize, 0, b[:4]); err != nil {
+		return
+	}
+	self.writeAckSize = size
 	return
 }
 
 func (self *Conn) writeSetPeerBandwidth(acksize uint32, limittype uint8) (err error) {
-	b := self.tmpwbuf(chunkHeaderLength + 5)
-	n := self.fillChunkHeader(b, 2, 0, msgtypeidSetPeerBandwidth, 0, 5)
-	pio.PutU32BE(b[n:], acksize)
-	n += 4
-	b[n] = limittype
-	n++
-	_, err = self.bufw.Write(b[:n])
-	return
+	b := self.tmpwbuf(5)
+	pio.PutU32BE(b, acksize)
+	b[4] = limittype
+	return self.writeMsg(false, 2, 0, msgtypeidSetPeerBandwidth, 0, b[:5])
 }
 
 func (self *Conn) writeCommandMsg(csid, msgsid uint32, args ...interface{}) (err error) {
@@ -990,119 +2629,255 @@ func (self *Conn) writeAMF0Msg(msgtypeid uint8, csid, msgsid uint32, args ...int
 		size += flv.LenAMF0Val(arg)
 	}
 
-	b := self.tmpwbuf(chunkHeaderLength + size)
-	n := self.fillChunkHeader(b, csid, 0, msgtypeid, msgsid, size)
+	b := self.tmpwbuf(size)
+	n := 0
 	for _, arg := range args {
 		n += flv.FillAMF0Val(b[n:], arg)
 	}
 
-	_, err = self.bufw.Write(b[:n])
-	return
+	return self.writeMsg(false, csid, 0, msgtypeid, msgsid, b[:n])
 }
 
+// writeAVTag takes the audio or video chunk stream for the whole message,
+// and wlock only chunk by chunk, so that audio and video written from
+// different goroutines interleave.
 func (self *Conn) writeAVTag(tag flv.Tag, ts int32) (err error) {
 	var msgtypeid uint8
 	var csid uint32
-	var data []byte
+	var cslock *sync.Mutex
 
 	switch tag.Type {
 	case flv.TAG_AUDIO:
 		msgtypeid = msgtypeidAudioMsg
 		csid = 6
-		data = tag.Data
+		cslock = &self.audiolock
 
 	case flv.TAG_VIDEO:
 		msgtypeid = msgtypeidVideoMsg
 		csid = 7
-		data = tag.Data
+		cslock = &self.videolock
 	}
 
-	actualChunkHeaderLength := chunkHeaderLength
-	if uint32(ts) > FlvTimestampMax {
-		actualChunkHeaderLength += 4
-	}
+	hdr := make([]byte, flv.MaxTagSubHeaderLength)
+	hdrlen := tag.FillHeader(hdr)
+
+	cslock.Lock()
+	defer cslock.Unlock()
+	return self.writeMsg(true, csid, ts, msgtypeid, self.avmsgsid, hdr[:hdrlen], tag.Data)
+}
 
-	b := self.tmpwbuf(actualChunkHeaderLength + flv.MaxTagSubHeaderLength)
-	hdrlen := tag.FillHeader(b[actualChunkHeaderLength:])
-	self.fillChunkHeader(b, csid, ts, msgtypeid, self.avmsgsid, hdrlen+len(data))
-	n := hdrlen + actualChunkHeaderLength
+func (self *Conn) writeStreamBegin(msgsid uint32) (err error) {
+	return self.writeStreamEvent(eventtypeStreamBegin, msgsid)
+}
 
-	if n+len(data) > self.writeMaxChunkSize {
-		if err = self.writeSetChunkSize(n + len(data)); err != nil {
-			return
-		}
+func (self *Conn) writeStreamEvent(eventtype uint16, msgsid uint32) (err error) {
+	b := self.tmpwbuf(6)
+	pio.PutU16BE(b, eventtype)
+	pio.PutU32BE(b[2:], msgsid)
+	return self.writeMsg(false, 2, 0, msgtypeidUserControl, 0, b[:6])
+}
+
+func (self *Conn) writeSetBufferLength(msgsid uint32, timestamp uint32) (err error) {
+	b := self.tmpwbuf(10)
+	pio.PutU16BE(b, eventtypeSetBufferLength)
+	pio.PutU32BE(b[2:], msgsid)
+	pio.PutU32BE(b[6:], timestamp)
+	return self.writeMsg(false, 2, 0, msgtypeidUserControl, 0, b[:10])
+}
+
+// writeMsg writes a message as a type 0 chunk and type 3 continuation
+// chunks of at most writeMaxChunkSize bytes. The caller holds wlock, or
+// with interleave the lock of the chunk stream, wlock is then taken here
+// and released between chunks.
+func (self *Conn) writeMsg(interleave bool, csid uint32, timestamp int32, msgtypeid uint8, msgsid uint32, payload ...[]byte) (err error) {
+	msgdatalen := 0
+	for _, b := range payload {
+		msgdatalen += len(b)
+	}
+
+	if interleave {
+		self.wlock.Lock()
+		defer self.wlock.Unlock()
 	}
 
-	if _, err = self.bufw.Write(b[:n]); err != nil {
+	var hdr [chunkHeaderLength + 4]byte
+	n := self.fillChunkHeader(hdr[:], csid, timestamp, msgtypeid, msgsid, msgdatalen)
+	if _, err = self.bufw.Write(hdr[:n]); err != nil {
 		return
 	}
-	_, err = self.bufw.Write(data)
-	return
-}
+	written := n + msgdatalen
 
-func (self *Conn) writeStreamBegin(msgsid uint32) (err error) {
-	b := self.tmpwbuf(chunkHeaderLength + 6)
-	n := self.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 6)
-	pio.PutU16BE(b[n:], eventtypeStreamBegin)
-	n += 2
-	pio.PutU32BE(b[n:], msgsid)
-	n += 4
-	_, err = self.bufw.Write(b[:n])
-	return
-}
+	left := self.writeMaxChunkSize
+	for _, b := range payload {
+		for len(b) > 0 {
+			if left == 0 {
+				if interleave {
+					self.wlock.Unlock()
+					self.wlock.Lock()
+				}
+				n = self.fillChunkContHeader(hdr[:], csid)
+				if _, err = self.bufw.Write(hdr[:n]); err != nil {
+					return
+				}
+				written += n
+				left = self.writeMaxChunkSize
+			}
+			size := len(b)
+			if size > left {
+				size = left
+			}
+			if _, err = self.bufw.Write(b[:size]); err != nil {
+				return
+			}
+			b = b[size:]
+			left -= size
+		}
+	}
 
-func (self *Conn) writeSetBufferLength(msgsid uint32, timestamp uint32) (err error) {
-	b := self.tmpwbuf(chunkHeaderLength + 10)
-	n := self.fillChunkHeader(b, 2, 0, msgtypeidUserControl, 0, 10)
-	pio.PutU16BE(b[n:], eventtypeSetBufferLength)
-	n += 2
-	pio.PutU32BE(b[n:], msgsid)
-	n += 4
-	pio.PutU32BE(b[n:], timestamp)
-	n += 4
-	_, err = self.bufw.Write(b[:n])
+	self.lock.Lock()
+	self.writeBytes += uint32(written)
+	self.lock.Unlock()
 	return
 }
 
 const chunkHeaderLength = 12
 const FlvTimestampMax = 0xFFFFFF
 
+// fillChunkHeader fills the header of the first chunk of a message. Type 1,
+// 2 and 3 headers are used when the message continues the previous one on
+// csid, unless fullChunkHeaders is set.
 func (self *Conn) fillChunkHeader(b []byte, csid uint32, timestamp int32, msgtypeid uint8, msgsid uint32, msgdatalen int) (n int) {
-	//  0                   1                   2                   3
-	//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
-	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-	// |                   timestamp                   |message length |
-	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-	// |     message length (cont)     |message type id| msg stream id |
-	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-	// |           message stream id (cont)            |
-	// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
-	//
-	//       Figure 9 Chunk Message Header – Type 0
-
-	b[n] = byte(csid) & 0x3f
-	n++
-	if uint32(timestamp) <= FlvTimestampMax {
-		pio.PutU24BE(b[n:], uint32(timestamp))
-	} else {
-		pio.PutU24BE(b[n:], FlvTimestampMax)
+	ts := uint32(timestamp)
+	cs := self.writecsmap[csid]
+	msghdrtype := uint8(0)
+	if cs == nil {
+		cs = &chunkStream{}
+		self.writecsmap[csid] = cs
+	} else if !self.fullChunkHeaders && cs.msgsid == msgsid && ts >= cs.timenow {
+		switch {
+		case cs.msgtypeid != msgtypeid || cs.msgdatalen != uint32(msgdatalen):
+			msghdrtype = 1
+		// a type 3 header after type 0 is read as a delta of 0 by some
+		// peers and of the whole timestamp by others
+		case cs.msghdrtype != 0 && ts-cs.timenow == cs.timedelta:
+			msghdrtype = 3
+		default:
+			msghdrtype = 2
+		}
 	}
-	n += 3
-	pio.PutU24BE(b[n:], uint32(msgdatalen))
-	n += 3
-	b[n] = msgtypeid
+
+	b[n] = msghdrtype<<6 | byte(csid)&0x3f
 	n++
-	pio.PutU32LE(b[n:], msgsid)
-	n += 4
-	if uint32(timestamp) > FlvTimestampMax {
-		pio.PutU32BE(b[n:], uint32(timestamp))
+
+	var timefield uint32
+	switch msghdrtype {
+	case 0:
+		//  0                   1                   2                   3
+		//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |                   timestamp                   |message length |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |     message length (cont)     |message type id| msg stream id |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |           message stream id (cont)            |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		//
+		//       Figure 9 Chunk Message Header – Type 0
+		timefield = ts
+		putChunkTime(b[n:], timefield)
+		n += 3
+		pio.PutU24BE(b[n:], uint32(msgdatalen))
+		n += 3
+		b[n] = msgtypeid
+		n++
+		pio.PutU32LE(b[n:], msgsid)
+		n += 4
+		cs.timenow = ts
+		cs.msgsid = msgsid
+		cs.msgtypeid = msgtypeid
+		cs.msgdatalen = uint32(msgdatalen)
+		cs.msghdrtype = msghdrtype
+
+	case 1:
+		//  0                   1                   2                   3
+		//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |                timestamp delta                |message length |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |     message length (cont)     |message type id|
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		//
+		//       Figure 10 Chunk Message Header – Type 1
+		timefield = ts - cs.timenow
+		putChunkTime(b[n:], timefield)
+		n += 3
+		pio.PutU24BE(b[n:], uint32(msgdatalen))
+		n += 3
+		b[n] = msgtypeid
+		n++
+		cs.timedelta = timefield
+		cs.timenow = ts
+		cs.msgtypeid = msgtypeid
+		cs.msgdatalen = uint32(msgdatalen)
+		cs.msghdrtype = msghdrtype
+
+	case 2:
+		//  0                   1                   2
+		//  0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		// |                timestamp delta                |
+		// +-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+-+
+		//
+		//       Figure 11 Chunk Message Header – Type 2
+		timefield = ts - cs.timenow
+		putChunkTime(b[n:], timefield)
+		n += 3
+		cs.timedelta = timefield
+		cs.timenow = ts
+		cs.msghdrtype = msghdrtype
+
+	case 3:
+		// the delta of the previous message is repeated
+		timefield = cs.timedelta
+		cs.timenow = ts
+	}
+
+	cs.hastimeext = timefield >= FlvTimestampMax
+	if cs.hastimeext {
+		pio.PutU32BE(b[n:], timefield)
 		n += 4
 	}
 
-	if Debug {
-		fmt.Printf("rtmp: write chunk msgdatalen=%d msgsid=%d\n", msgdatalen, msgsid)
+	if self.tracing() {
+		self.log(LevelTrace, "> chunk", "csid", csid, "msghdrtype", msghdrtype, "msgtypeid", msgtypeid, "msgsid", msgsid, "len", msgdatalen)
+	}
+
+	return
+}
+
+// putChunkTime fills the 3 byte timestamp or delta of a chunk header,
+// larger values go to the extended timestamp.
+func putChunkTime(b []byte, timefield uint32) {
+	if timefield >= FlvTimestampMax {
+		timefield = FlvTimestampMax
 	}
+	pio.PutU24BE(b, timefield)
+}
 
+// fillChunkContHeader fills the type 3 header of a continuation chunk, it
+// repeats the extended timestamp of the first chunk.
+func (self *Conn) fillChunkContHeader(b []byte, csid uint32) (n int) {
+	cs := self.writecsmap[csid]
+	b[n] = 0xc0 | byte(csid)&0x3f
+	n++
+	if cs.hastimeext {
+		timefield := cs.timedelta
+		if cs.msghdrtype == 0 {
+			timefield = cs.timenow
+		}
+		pio.PutU32BE(b[n:], timefield)
+		n += 4
+	}
 	return
 }
 
@@ -1166,7 +2941,7 @@ func (self *Conn) readChunk() (err error) {
 		//
 		//       Figure 9 Chunk Message Header – Type 0
 		if cs.msgdataleft != 0 {
-			err = fmt.Errorf("rtmp: chunk msgdataleft=%d invalid", cs.msgdataleft)
+			err = protocolError("chunk msgdataleft=%d invalid", cs.msgdataleft)
 			return
 		}
 		h := b[:11]
@@ -1203,7 +2978,7 @@ func (self *Conn) readChunk() (err error) {
 		//
 		//       Figure 10 Chunk Message Header – Type 1
 		if cs.msgdataleft != 0 {
-			err = fmt.Errorf("rtmp: chunk msgdataleft=%d invalid", cs.msgdataleft)
+			err = protocolError("chunk msgdataleft=%d invalid", cs.msgdataleft)
 			return
 		}
 		h := b[:7]
@@ -1238,7 +3013,7 @@ func (self *Conn) readChunk() (err error) {
 		//
 		//       Figure 11 Chunk Message Header – Type 2
 		if cs.msgdataleft != 0 {
-			err = fmt.Errorf("rtmp: chunk msgdataleft=%d invalid", cs.msgdataleft)
+			err = protocolError("chunk msgdataleft=%d invalid", cs.msgdataleft)
 			return
 		}
 		h := b[:3]
@@ -1287,10 +3062,16 @@ func (self *Conn) readChunk() (err error) {
 				cs.timenow += timestamp
 			}
 			cs.Start()
+		} else if cs.hastimeext {
+			// continuation chunks repeat the extended timestamp
+			if _, err = io.ReadFull(self.bufr, b[:4]); err != nil {
+				return
+			}
+			n += 4
 		}
 
 	default:
-		err = fmt.Errorf("rtmp: invalid chunk msg header type=%d", msghdrtype)
+		err = protocolError("invalid chunk msg header type=%d", msghdrtype)
 		return
 	}
 
@@ -1306,53 +3087,60 @@ func (self *Conn) readChunk() (err error) {
 	n += len(buf)
 	cs.msgdataleft -= uint32(size)
 
-	if Debug {
-		fmt.Printf("rtmp: chunk msgsid=%d msgtypeid=%d msghdrtype=%d len=%d left=%d\n",
-			cs.msgsid, cs.msgtypeid, cs.msghdrtype, cs.msgdatalen, cs.msgdataleft)
+	if self.tracing() {
+		self.log(LevelTrace, "< chunk", "csid", csid, "msghdrtype", msghdrtype, "msgtypeid", cs.msgtypeid, "msgsid", cs.msgsid, "len", cs.msgdatalen, "left", cs.msgdataleft)
 	}
 
 	if cs.msgdataleft == 0 {
-		if Debug {
-			fmt.Println("rtmp: chunk data")
-			fmt.Print(hex.Dump(cs.msgdata))
-		}
-
 		if err = self.handleMsg(cs.timenow, cs.msgsid, cs.msgtypeid, cs.msgdata); err != nil {
 			return
 		}
 	}
 
 	self.ackn += uint32(n)
-	if self.readAckSize != 0 && self.ackn > self.readAckSize {
-		if err = self.writeAck(self.ackn); err != nil {
+	if self.readAckSize != 0 && self.ackn-self.acklast > self.readAckSize {
+		self.wlock.Lock()
+		if err = self.writeAck(self.ackn); err == nil {
+			err = self.flushWrite()
+		}
+		self.wlock.Unlock()
+		if err != nil {
 			return
 		}
-		self.ackn = 0
+		self.acklast = self.ackn
 	}
 
 	return
 }
 
+// parseAMF0Val is flv.ParseAMF0Val with its error as a ProtocolError.
+func parseAMF0Val(b []byte, msg string) (val interface{}, n int, err error) {
+	if val, n, err = flv.ParseAMF0Val(b); err != nil {
+		err = &ProtocolError{Msg: msg + " invalid", Err: err}
+	}
+	return
+}
+
 func (self *Conn) handleCommandMsgAMF0(b []byte) (n int, err error) {
 	var name, transid, obj interface{}
 	var size int
 
-	if name, size, err = flv.ParseAMF0Val(b[n:]); err != nil {
+	if name, size, err = parseAMF0Val(b[n:], "CommandMsgAMF0"); err != nil {
 		return
 	}
 	n += size
-	if transid, size, err = flv.ParseAMF0Val(b[n:]); err != nil {
+	if transid, size, err = parseAMF0Val(b[n:], "CommandMsgAMF0"); err != nil {
 		return
 	}
 	n += size
-	if obj, size, err = flv.ParseAMF0Val(b[n:]); err != nil {
+	if obj, size, err = parseAMF0Val(b[n:], "CommandMsgAMF0"); err != nil {
 		return
 	}
 	n += size
 
 	var ok bool
 	if self.commandname, ok = name.(string); !ok {
-		err = fmt.Errorf("rtmp: CommandMsgAMF0 command is not string")
+		err = protocolError("CommandMsgAMF0 command is not string")
 		return
 	}
 	self.commandtransid, _ = transid.(float64)
@@ -1360,22 +3148,49 @@ func (self *Conn) handleCommandMsgAMF0(b []byte) (n int, err error) {
 	self.commandparams = []interface{}{}
 
 	for n < len(b) {
-		if obj, size, err = flv.ParseAMF0Val(b[n:]); err != nil {
+		if obj, size, err = parseAMF0Val(b[n:], "CommandMsgAMF0"); err != nil {
 			return
 		}
 		n += size
 		self.commandparams = append(self.commandparams, obj)
 	}
 	if n < len(b) {
-		err = fmt.Errorf("rtmp: CommandMsgAMF0 left bytes=%d", len(b)-n)
+		err = protocolError("CommandMsgAMF0 left bytes=%d", len(b)-n)
 		return
 	}
 
+	if self.tracing() {
+		self.log(LevelTrace, "< command", "name", self.commandname, "transid", self.commandtransid, "obj", self.commandobj, "params", self.commandparams)
+	}
+
 	self.gotcommand = true
 	return
 }
 
+func (self *Conn) handleDataMsgAMF0(b []byte) (err error) {
+	n := 0
+	for n < len(b) {
+		var obj interface{}
+		var size int
+		if obj, size, err = parseAMF0Val(b[n:], "DataMsgAMF0"); err != nil {
+			return
+		}
+		n += size
+		self.datamsgvals = append(self.datamsgvals, obj)
+	}
+	if n < len(b) {
+		err = protocolError("DataMsgAMF0 left bytes=%d", len(b)-n)
+		return
+	}
+	return
+}
+
 func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, msgdata []byte) (err error) {
+	self.lock.Lock()
+	self.lastSeen = time.Now()
+	self.lock.Unlock()
+
+	self.msgsid = msgsid
 	self.msgdata = msgdata
 	self.msgtypeid = msgtypeid
 	self.timestamp = timestamp
@@ -1388,35 +3203,44 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 
 	case msgtypeidCommandMsgAMF3:
 		if len(msgdata) < 1 {
-			err = fmt.Errorf("rtmp: short packet of CommandMsgAMF3")
+			err = protocolError("short packet of CommandMsgAMF3")
 			return
 		}
-		// skip first byte
+		// skip format byte, values are AMF0 which switch to AMF3 with
+		// the avmplus marker
 		if _, err = self.handleCommandMsgAMF0(msgdata[1:]); err != nil {
 			return
 		}
 
 	case msgtypeidUserControl:
 		if len(msgdata) < 2 {
-			err = fmt.Errorf("rtmp: short packet of UserControl")
+			err = protocolError("short packet of UserControl")
 			return
 		}
 		self.eventtype = pio.U16BE(msgdata)
-
-	case msgtypeidDataMsgAMF0:
-		b := msgdata
-		n := 0
-		for n < len(b) {
-			var obj interface{}
-			var size int
-			if obj, size, err = flv.ParseAMF0Val(b[n:]); err != nil {
+		switch self.eventtype {
+		case eventtypePingRequest, eventtypePingResponse:
+			if len(msgdata) < 6 {
+				err = protocolError("short packet of UserControl")
+				return
+			}
+			if err = self.handlePing(self.eventtype, pio.U32BE(msgdata[2:])); err != nil {
 				return
 			}
-			n += size
-			self.datamsgvals = append(self.datamsgvals, obj)
+			return
+		}
+
+	case msgtypeidDataMsgAMF0:
+		if err = self.handleDataMsgAMF0(msgdata); err != nil {
+			return
 		}
-		if n < len(b) {
-			err = fmt.Errorf("rtmp: DataMsgAMF0 left bytes=%d", len(b)-n)
+
+	case msgtypeidDataMsgAMF3:
+		if len(msgdata) < 1 {
+			err = protocolError("short packet of DataMsgAMF3")
+			return
+		}
+		if err = self.handleDataMsgAMF0(msgdata[1:]); err != nil {
 			return
 		}
 
@@ -1427,6 +3251,7 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 		tag := flv.Tag{Type: flv.TAG_VIDEO}
 		var n int
 		if n, err = (&tag).ParseHeader(msgdata); err != nil {
+			err = &ProtocolError{Msg: "VideoMsg invalid", Err: err}
 			return
 		}
 		if !(tag.FrameType == flv.FRAME_INTER || tag.FrameType == flv.FRAME_KEY) {
@@ -1442,6 +3267,7 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 		tag := flv.Tag{Type: flv.TAG_AUDIO}
 		var n int
 		if n, err = (&tag).ParseHeader(msgdata); err != nil {
+			err = &ProtocolError{Msg: "AudioMsg invalid", Err: err}
 			return
 		}
 		tag.Data = msgdata[n:]
@@ -1449,11 +3275,37 @@ func (self *Conn) handleMsg(timestamp uint32, msgsid uint32, msgtypeid uint8, ms
 
 	case msgtypeidSetChunkSize:
 		if len(msgdata) < 4 {
-			err = fmt.Errorf("rtmp: short packet of SetChunkSize")
+			err = protocolError("short packet of SetChunkSize")
 			return
 		}
 		self.readMaxChunkSize = int(pio.U32BE(msgdata))
 		return
+
+	case msgtypeidAck:
+		if len(msgdata) < 4 {
+			err = protocolError("short packet of Ack")
+			return
+		}
+		self.handleAck(pio.U32BE(msgdata))
+		return
+
+	case msgtypeidWindowAckSize:
+		if len(msgdata) < 4 {
+			err = protocolError("short packet of WindowAckSize")
+			return
+		}
+		self.readAckSize = pio.U32BE(msgdata)
+		return
+
+	case msgtypeidSetPeerBandwidth:
+		if len(msgdata) < 5 {
+			err = protocolError("short packet of SetPeerBandwidth")
+			return
+		}
+		if err = self.setPeerBandwidth(pio.U32BE(msgdata), msgdata[4]); err != nil {
+			return
+		}
+		return
 	}
 
 	self.gotmsg = true
@@ -1482,6 +3334,9 @@ var (
 	hsServerPartialKey = hsServerFullKey[:36]
 )
 
+// flash player version sent in C1 of the digest handshake
+const hsClientVersion = 0x80000702
+
 func hsMakeDigest(key []byte, src []byte, gap int) (dst []byte) {
 	h := hmac.New(sha256.New, key)
 	if gap <= 0 {
@@ -1510,13 +3365,22 @@ func hsFindDigest(p []byte, key []byte, base int) int {
 	return gap
 }
 
-func hsParse1(p []byte, peerkey []byte, key []byte) (ok bool, digest []byte) {
-	var pos int
-	if pos = hsFindDigest(p, peerkey, 772); pos == -1 {
-		if pos = hsFindDigest(p, peerkey, 8); pos == -1 {
+// hsLocateDigest tries both digest layouts of C1/S1, returns the base
+// offset of the matched layout and the digest position, or pos=-1.
+func hsLocateDigest(p []byte, peerkey []byte) (base int, pos int) {
+	for _, base = range []int{772, 8} {
+		if pos = hsFindDigest(p, peerkey, base); pos != -1 {
 			return
 		}
 	}
+	return
+}
+
+func hsParse1(p []byte, peerkey []byte, key []byte) (ok bool, digest []byte) {
+	var pos int
+	if _, pos = hsLocateDigest(p, peerkey); pos == -1 {
+		return
+	}
 	ok = true
 	digest = hsMakeDigest(key, p[pos:pos+32], -1)
 	return
@@ -1533,6 +3397,15 @@ func hsCreate01(p []byte, time uint32, ver uint32, key []byte) {
 	copy(p1[gap:], digest)
 }
 
+// hsCheck2 verifies the digest at the tail of S2 (or C2), which is signed
+// with a key derived from the digest we sent in C1 (or S1).
+func hsCheck2(p []byte, p1 []byte, key []byte) bool {
+	gap := hsCalcDigestPos(p1, 8)
+	digest := hsMakeDigest(key, p1[gap:gap+32], -1)
+	expect := hsMakeDigest(digest, p, len(p)-32)
+	return bytes.Equal(p[len(p)-32:], expect)
+}
+
 func hsCreate2(p []byte, key []byte) {
 	rand.Read(p)
 	gap := len(p) - 32
@@ -1541,22 +3414,28 @@ func hsCreate2(p []byte, key []byte) {
 }
 
 func (self *Conn) handshakeClient() (err error) {
+	if self.encrypted {
+		return self.handshakeClientEncrypted()
+	}
+
 	var random [(1 + 1536*2) * 2]byte
 
 	C0C1C2 := random[:1536*2+1]
 	C0 := C0C1C2[:1]
-	//C1 := C0C1C2[1:1536+1]
+	C1 := C0C1C2[1 : 1536+1]
 	C0C1 := C0C1C2[:1536+1]
 	C2 := C0C1C2[1536+1:]
 
 	S0S1S2 := random[1536*2+1:]
-	//S0 := S0S1S2[:1]
+	S0 := S0S1S2[:1]
 	S1 := S0S1S2[1 : 1536+1]
-	//S0S1 := S0S1S2[:1536+1]
-	//S2 := S0S1S2[1536+1:]
+	S2 := S0S1S2[1536+1:]
 
-	C0[0] = 3
-	//hsCreate01(C0C1, hsClientFullKey)
+	if self.simpleHandshake {
+		C0[0] = 3
+	} else {
+		hsCreate01(C0C1, 0, hsClientVersion, hsClientPartialKey)
+	}
 
 	// > C0C1
 	if _, err = self.bufw.Write(C0C1); err != nil {
@@ -1570,15 +3449,26 @@ func (self *Conn) handshakeClient() (err error) {
 	if _, err = io.ReadFull(self.bufr, S0S1S2); err != nil {
 		return
 	}
-
-	if Debug {
-		fmt.Println("rtmp: handshakeClient: server version", S1[4], S1[5], S1[6], S1[7])
+	if S0[0] != 3 {
+		err = handshakeError("version=%d invalid", S0[0])
+		return
 	}
 
-	if ver := pio.U32BE(S1[4:8]); ver != 0 {
-		C2 = S1
+	self.log(LevelDebug, "handshake", "version", fmt.Sprintf("%d.%d.%d.%d", S1[4], S1[5], S1[6], S1[7]))
+
+	srvver := pio.U32BE(S1[4:8])
+	if !self.simpleHandshake && srvver != 0 {
+		if ok, digest := hsParse1(S1, hsServerPartialKey, hsClientFullKey); ok {
+			hsCreate2(C2, digest)
+			if !hsCheck2(S2, C1, hsServerFullKey) {
+				self.log(LevelDebug, "handshake S2 digest mismatch")
+			}
+		} else {
+			self.log(LevelDebug, "handshake S1 digest invalid, fallback to simple handshake")
+			copy(C2, S1)
+		}
 	} else {
-		C2 = S1
+		copy(C2, S1)
 	}
 
 	// > C2
@@ -1609,8 +3499,15 @@ func (self *Conn) handshakeServer() (err error) {
 	if _, err = io.ReadFull(self.bufr, C0C1); err != nil {
 		return
 	}
-	if C0[0] != 3 {
-		err = fmt.Errorf("rtmp: handshake version=%d invalid", C0[0])
+	switch C0[0] {
+	case hsVersionPlain:
+	case hsVersionEncrypted:
+		return self.handshakeServerEncrypted(C0C1)
+	case hsVersionXTEA:
+		err = handshakeError("version=%d (rtmpe xtea) not supported", C0[0])
+		return
+	default:
+		err = handshakeError("version=%d invalid", C0[0])
 		return
 	}
 
@@ -1625,7 +3522,7 @@ func (self *Conn) handshakeServer() (err error) {
 		var ok bool
 		var digest []byte
 		if ok, digest = hsParse1(C1, hsClientPartialKey, hsServerFullKey); !ok {
-			err = fmt.Errorf("rtmp: handshake server: C1 invalid")
+			err = handshakeError("server: C1 invalid")
 			return
 		}
 		hsCreate01(S0S1, srvtime, srvver, hsServerPartialKey)
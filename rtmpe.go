@@ -0,0 +1,266 @@
+package rtmp
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha256"
+	"io"
+	"math/big"
+
+	"github.com/notedit/rtmp-lib/pio"
+)
+
+// RTMPE handshake: C0/S0 version 6, a Diffie-Hellman public key is carried
+// in C1/S1 next to the digest, and everything after the handshake is RC4
+// encrypted with keys derived from the shared secret.
+
+const (
+	hsVersionPlain     = 3
+	hsVersionEncrypted = 6
+	hsVersionXTEA      = 8
+)
+
+const hsDHKeyLength = 128
+
+// 1024-bit MODP group, RFC 2409 section 6.2
+var hsDHPrime, _ = new(big.Int).SetString(
+	"FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1"+
+		"29024E088A67CC74020BBEA63B139B22514A08798E3404DD"+
+		"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245"+
+		"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED"+
+		"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE65381"+
+		"FFFFFFFFFFFFFFFF", 16)
+
+var hsDHGenerator = big.NewInt(2)
+
+type hsDH struct {
+	priv *big.Int
+	pub  *big.Int
+}
+
+func newHsDH() (self *hsDH, err error) {
+	b := make([]byte, hsDHKeyLength)
+	if _, err = rand.Read(b); err != nil {
+		return
+	}
+	self = &hsDH{}
+	self.priv = new(big.Int).SetBytes(b)
+	self.pub = new(big.Int).Exp(hsDHGenerator, self.priv, hsDHPrime)
+	return
+}
+
+func (self *hsDH) PublicKey() []byte {
+	b := make([]byte, hsDHKeyLength)
+	pub := self.pub.Bytes()
+	copy(b[hsDHKeyLength-len(pub):], pub)
+	return b
+}
+
+func (self *hsDH) SharedSecret(peerpub []byte) (secret []byte, err error) {
+	y := new(big.Int).SetBytes(peerpub)
+	max := new(big.Int).Sub(hsDHPrime, big.NewInt(1))
+	if y.Cmp(big.NewInt(1)) <= 0 || y.Cmp(max) >= 0 {
+		err = handshakeError("dh public key invalid")
+		return
+	}
+	s := new(big.Int).Exp(y, self.priv, hsDHPrime).Bytes()
+	secret = make([]byte, hsDHKeyLength)
+	copy(secret[hsDHKeyLength-len(s):], s)
+	return
+}
+
+// hsCalcDHPos returns the dh public key offset inside C1/S1. It depends on
+// which of the two digest layouts (base 8 or base 772) the peer used.
+func hsCalcDHPos(p []byte, digestbase int) (pos int) {
+	base := 1532
+	if digestbase != 8 {
+		base = 768
+	}
+	for i := 0; i < 4; i++ {
+		pos += int(p[base+i])
+	}
+	if digestbase == 8 {
+		pos = (pos % 632) + 772
+	} else {
+		pos = (pos % 632) + 8
+	}
+	return
+}
+
+func hsCreateEncrypted01(p []byte, time uint32, ver uint32, key []byte, digestbase int, pubkey []byte) {
+	p[0] = hsVersionEncrypted
+	p1 := p[1:]
+	rand.Read(p1[8:])
+	pio.PutU32BE(p1[0:4], time)
+	pio.PutU32BE(p1[4:8], ver)
+	copy(p1[hsCalcDHPos(p1, digestbase):], pubkey)
+	gap := hsCalcDigestPos(p1, digestbase)
+	digest := hsMakeDigest(key, p1, gap)
+	copy(p1[gap:], digest)
+}
+
+// hsRC4Ciphers derives the RC4 streams from the dh shared secret, the
+// outgoing key is signed with the peer public key and the incoming key with
+// our own. Both keystreams skip the first 1536 bytes, as flash player does.
+func hsRC4Ciphers(secret, localpub, peerpub []byte) (enc, dec cipher.Stream, err error) {
+	keyof := func(pub []byte) []byte {
+		h := hmac.New(sha256.New, secret)
+		h.Write(pub)
+		return h.Sum(nil)[:16]
+	}
+
+	var encrc4, decrc4 *rc4.Cipher
+	if encrc4, err = rc4.NewCipher(keyof(peerpub)); err != nil {
+		return
+	}
+	if decrc4, err = rc4.NewCipher(keyof(localpub)); err != nil {
+		return
+	}
+
+	skip := make([]byte, 1536)
+	encrc4.XORKeyStream(skip, skip)
+	decrc4.XORKeyStream(skip, skip)
+
+	enc, dec = encrc4, decrc4
+	return
+}
+
+// startEncryption makes bufr/bufw transparently decrypt/encrypt the chunk
+// stream. Bytes already buffered in bufr are decrypted too.
+func (self *Conn) startEncryption(enc, dec cipher.Stream) (err error) {
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+	self.bufr = bufio.NewReaderSize(&cipher.StreamReader{S: dec, R: self.bufr}, self.bufr.Size())
+	self.bufw = bufio.NewWriterSize(&cipher.StreamWriter{S: enc, W: self.txrxcount}, self.bufw.Size())
+	return
+}
+
+func (self *Conn) handshakeClientEncrypted() (err error) {
+	var random [(1 + 1536*2) * 2]byte
+
+	C0C1C2 := random[:1536*2+1]
+	C0C1 := C0C1C2[:1536+1]
+	C2 := C0C1C2[1536+1:]
+
+	S0S1S2 := random[1536*2+1:]
+	S0 := S0S1S2[:1]
+	S1 := S0S1S2[1 : 1536+1]
+
+	var dh *hsDH
+	if dh, err = newHsDH(); err != nil {
+		return
+	}
+	clipub := dh.PublicKey()
+	hsCreateEncrypted01(C0C1, 0, hsClientVersion, hsClientPartialKey, 8, clipub)
+
+	// > C0C1
+	if _, err = self.bufw.Write(C0C1); err != nil {
+		return
+	}
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+
+	// < S0S1S2
+	if _, err = io.ReadFull(self.bufr, S0S1S2); err != nil {
+		return
+	}
+	if S0[0] != hsVersionEncrypted {
+		err = handshakeError("encrypted version=%d invalid", S0[0])
+		return
+	}
+
+	base, pos := hsLocateDigest(S1, hsServerPartialKey)
+	if pos == -1 {
+		err = handshakeError("client: S1 invalid")
+		return
+	}
+	dhpos := hsCalcDHPos(S1, base)
+	srvpub := S1[dhpos : dhpos+hsDHKeyLength]
+
+	var secret []byte
+	if secret, err = dh.SharedSecret(srvpub); err != nil {
+		return
+	}
+	var enc, dec cipher.Stream
+	if enc, dec, err = hsRC4Ciphers(secret, clipub, srvpub); err != nil {
+		return
+	}
+
+	hsCreate2(C2, hsMakeDigest(hsClientFullKey, S1[pos:pos+32], -1))
+
+	// > C2
+	if _, err = self.bufw.Write(C2); err != nil {
+		return
+	}
+
+	if err = self.startEncryption(enc, dec); err != nil {
+		return
+	}
+
+	self.stage++
+	return
+}
+
+func (self *Conn) handshakeServerEncrypted(C0C1 []byte) (err error) {
+	var random [1536 + (1 + 1536*2)]byte
+
+	C1 := C0C1[1:]
+	C2 := random[:1536]
+
+	S0S1S2 := random[1536:]
+	S0S1 := S0S1S2[:1536+1]
+	S2 := S0S1S2[1536+1:]
+
+	base, pos := hsLocateDigest(C1, hsClientPartialKey)
+	if pos == -1 {
+		err = handshakeError("server: C1 invalid")
+		return
+	}
+	dhpos := hsCalcDHPos(C1, base)
+	clipub := C1[dhpos : dhpos+hsDHKeyLength]
+
+	var dh *hsDH
+	if dh, err = newHsDH(); err != nil {
+		return
+	}
+	srvpub := dh.PublicKey()
+
+	var secret []byte
+	if secret, err = dh.SharedSecret(clipub); err != nil {
+		return
+	}
+	var enc, dec cipher.Stream
+	if enc, dec, err = hsRC4Ciphers(secret, srvpub, clipub); err != nil {
+		return
+	}
+
+	srvtime := pio.U32BE(C1[0:4])
+	srvver := uint32(0x0d0e0a0d)
+	hsCreateEncrypted01(S0S1, srvtime, srvver, hsServerPartialKey, base, srvpub)
+	hsCreate2(S2, hsMakeDigest(hsServerFullKey, C1[pos:pos+32], -1))
+
+	// > S0S1S2
+	if _, err = self.bufw.Write(S0S1S2); err != nil {
+		return
+	}
+	if err = self.bufw.Flush(); err != nil {
+		return
+	}
+
+	// < C2
+	if _, err = io.ReadFull(self.bufr, C2); err != nil {
+		return
+	}
+
+	if err = self.startEncryption(enc, dec); err != nil {
+		return
+	}
+
+	self.stage++
+	return
+}
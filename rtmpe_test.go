@@ -0,0 +1,106 @@
+package rtmp
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestDHSharedSecret(t *testing.T) {
+	a, err := newHsDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := newHsDH()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a.PublicKey()) != hsDHKeyLength {
+		t.Fatalf("public key is %d bytes, want %d", len(a.PublicKey()), hsDHKeyLength)
+	}
+
+	s1, err := a.SharedSecret(b.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := b.SharedSecret(a.PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s1, s2) {
+		t.Fatalf("shared secrets differ")
+	}
+
+	for _, pub := range [][]byte{{0}, {1}, hsDHPrime.Bytes()} {
+		if _, err := a.SharedSecret(pub); err == nil {
+			t.Errorf("public key % x accepted", pub)
+		}
+	}
+}
+
+// recordConn keeps what was read from the connection.
+type recordConn struct {
+	net.Conn
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (self *recordConn) Read(p []byte) (n int, err error) {
+	n, err = self.Conn.Read(p)
+	self.lock.Lock()
+	self.buf.Write(p[:n])
+	self.lock.Unlock()
+	return
+}
+
+func TestEncryptedHandshake(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+	wire := &recordConn{Conn: srvconn}
+
+	client := NewConn(cliconn, 4096)
+	client.encrypted = true
+	server := NewConn(wire, 4096)
+	server.isserver = true
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.handshakeServer()
+	}()
+	if err := client.handshakeClient(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake: %v", err)
+	}
+
+	// a command each way over the rc4 streams
+	exchange := func(from, to *Conn, name, arg string) {
+		go func() {
+			err := from.writeCommandMsg(3, 0, name, 1, nil, arg)
+			if err == nil {
+				err = from.flushWrite()
+			}
+			errc <- err
+		}()
+		if err := to.pollCommand(); err != nil {
+			t.Fatalf("%s: read: %v", name, err)
+		}
+		if err := <-errc; err != nil {
+			t.Fatalf("%s: write: %v", name, err)
+		}
+		if to.commandname != name || len(to.commandparams) != 1 || to.commandparams[0] != arg {
+			t.Fatalf("%s: got %s %v", name, to.commandname, to.commandparams)
+		}
+	}
+	exchange(client, server, "fromClient", "encrypted payload")
+	exchange(server, client, "fromServer", "encrypted reply")
+
+	wire.lock.Lock()
+	defer wire.lock.Unlock()
+	if bytes.Contains(wire.buf.Bytes(), []byte("encrypted payload")) {
+		t.Errorf("the command went over the wire in clear")
+	}
+}
@@ -0,0 +1,519 @@
+package rtmp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RTMPT tunnels the rtmp byte stream over http POST requests:
+//
+//     /open/1            -> session id
+//     /send/<id>/<seq>   body is client data, response is server data
+//     /idle/<id>/<seq>   poll, response is server data
+//     /close/<id>/<seq>  close session
+//
+// Every response body except /open starts with one byte, the polling
+// interval the client should wait before the next /idle.
+
+const tunnelContentType = "application/x-fcs"
+
+const tunnelMaxInterval = 0x21
+
+// max bytes buffered in one direction before Write blocks, also the max
+// body of a request or response
+const tunnelMaxBuffered = 1024 * 1024 * 4
+
+var TunnelSessionTimeout = time.Second * 30
+
+var errTunnelClosed = fmt.Errorf("rtmp: tunnel closed")
+
+// tunnelConn is the net.Conn seen by Conn on both ends of a tunnel, inbuf
+// holds bytes received from the peer and outbuf bytes waiting for a poll.
+type tunnelConn struct {
+	lock   *sync.Mutex
+	cond   *sync.Cond
+	inbuf  bytes.Buffer
+	outbuf bytes.Buffer
+	closed bool
+
+	readDeadline, writeDeadline time.Time
+	readTimer, writeTimer       *time.Timer
+
+	localaddr, remoteaddr net.Addr
+	onclose               func()
+}
+
+func newTunnelConn(localaddr, remoteaddr net.Addr) *tunnelConn {
+	self := &tunnelConn{
+		lock:       &sync.Mutex{},
+		localaddr:  localaddr,
+		remoteaddr: remoteaddr,
+	}
+	self.cond = sync.NewCond(self.lock)
+	return self
+}
+
+func tunnelDeadlineExceeded(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+func (self *tunnelConn) Read(p []byte) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.inbuf.Len() == 0 && !self.closed {
+		if tunnelDeadlineExceeded(self.readDeadline) {
+			err = tunnelTimeoutError{}
+			return
+		}
+		self.cond.Wait()
+	}
+	if self.inbuf.Len() == 0 {
+		err = io.EOF
+		return
+	}
+	n, _ = self.inbuf.Read(p)
+	self.cond.Broadcast()
+	return
+}
+
+func (self *tunnelConn) Write(p []byte) (n int, err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.outbuf.Len() > tunnelMaxBuffered && !self.closed {
+		if tunnelDeadlineExceeded(self.writeDeadline) {
+			err = tunnelTimeoutError{}
+			return
+		}
+		self.cond.Wait()
+	}
+	if self.closed {
+		err = errTunnelClosed
+		return
+	}
+	n, _ = self.outbuf.Write(p)
+	self.cond.Broadcast()
+	return
+}
+
+// push appends bytes received from the peer. It waits while inbuf is full,
+// which holds back the request or the poll of the peer.
+func (self *tunnelConn) push(b []byte) (err error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	for self.inbuf.Len() > 0 && self.inbuf.Len()+len(b) > tunnelMaxBuffered && !self.closed {
+		self.cond.Wait()
+	}
+	if self.closed {
+		err = errTunnelClosed
+		return
+	}
+	self.inbuf.Write(b)
+	self.cond.Broadcast()
+	return
+}
+
+// pull takes the bytes waiting to be sent to the peer, at most
+// tunnelMaxBuffered.
+func (self *tunnelConn) pull() (b []byte) {
+	self.lock.Lock()
+	if n := self.outbuf.Len(); n > 0 {
+		if n > tunnelMaxBuffered {
+			n = tunnelMaxBuffered
+		}
+		b = make([]byte, n)
+		self.outbuf.Read(b)
+		self.cond.Broadcast()
+	}
+	self.lock.Unlock()
+	return
+}
+
+// drained reports whether the conn is closed and its peer took all of
+// outbuf.
+func (self *tunnelConn) drained() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.closed && self.outbuf.Len() == 0
+}
+
+func (self *tunnelConn) Close() error {
+	self.lock.Lock()
+	if self.closed {
+		self.lock.Unlock()
+		return nil
+	}
+	self.closed = true
+	self.readTimer = self.armDeadline(self.readTimer, time.Time{})
+	self.writeTimer = self.armDeadline(self.writeTimer, time.Time{})
+	self.cond.Broadcast()
+	onclose := self.onclose
+	self.lock.Unlock()
+
+	if onclose != nil {
+		onclose()
+	}
+	return nil
+}
+
+func (self *tunnelConn) LocalAddr() net.Addr {
+	return self.localaddr
+}
+
+func (self *tunnelConn) RemoteAddr() net.Addr {
+	return self.remoteaddr
+}
+
+func (self *tunnelConn) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	self.SetWriteDeadline(t)
+	return nil
+}
+
+func (self *tunnelConn) SetReadDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.readDeadline = t
+	self.readTimer = self.armDeadline(self.readTimer, t)
+	self.lock.Unlock()
+	return nil
+}
+
+func (self *tunnelConn) SetWriteDeadline(t time.Time) error {
+	self.lock.Lock()
+	self.writeDeadline = t
+	self.writeTimer = self.armDeadline(self.writeTimer, t)
+	self.lock.Unlock()
+	return nil
+}
+
+// armDeadline replaces timer with one that wakes up blocked Read/Write
+// when t is reached.
+func (self *tunnelConn) armDeadline(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		self.lock.Lock()
+		self.cond.Broadcast()
+		self.lock.Unlock()
+	})
+}
+
+type tunnelTimeoutError struct{}
+
+func (tunnelTimeoutError) Error() string   { return "rtmp: tunnel i/o timeout" }
+func (tunnelTimeoutError) Timeout() bool   { return true }
+func (tunnelTimeoutError) Temporary() bool { return true }
+
+type tunnelAddr string
+
+func (self tunnelAddr) Network() string { return "rtmpt" }
+func (self tunnelAddr) String() string  { return string(self) }
+
+type tunnelSession struct {
+	id       string
+	conn     *tunnelConn
+	interval byte
+	timer    *time.Timer
+}
+
+// TunnelHandler serves RTMPT, each tunnel session becomes a Conn handled
+// by the Server like a plain tcp connection.
+//
+//	http.Handle("/", rtmp.NewTunnelHandler(server))
+type TunnelHandler struct {
+	server   *Server
+	lock     *sync.Mutex
+	sessions map[string]*tunnelSession
+}
+
+func NewTunnelHandler(server *Server) *TunnelHandler {
+	return &TunnelHandler{
+		server:   server,
+		lock:     &sync.Mutex{},
+		sessions: make(map[string]*tunnelSession),
+	}
+}
+
+func (self *TunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	pathsegs := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch pathsegs[0] {
+	case "open":
+		self.handleOpen(w, r)
+
+	case "send", "idle", "close":
+		if len(pathsegs) < 2 {
+			http.NotFound(w, r)
+			return
+		}
+		self.lock.Lock()
+		session := self.sessions[pathsegs[1]]
+		self.lock.Unlock()
+		if session == nil {
+			http.NotFound(w, r)
+			return
+		}
+		session.timer.Reset(TunnelSessionTimeout)
+
+		switch pathsegs[0] {
+		case "send":
+			body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, tunnelMaxBuffered))
+			if err != nil {
+				session.conn.Close()
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+				return
+			}
+			if err = session.conn.push(body); err != nil {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			self.writePending(w, session)
+
+		case "idle":
+			self.writePending(w, session)
+
+		case "close":
+			session.conn.Close()
+			self.removeSession(session)
+			self.writeResponse(w, []byte{0})
+		}
+
+	default:
+		// including /fcs/ident2, which flash player probes first
+		http.NotFound(w, r)
+	}
+}
+
+func (self *TunnelHandler) handleOpen(w http.ResponseWriter, r *http.Request) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(b)
+
+	session := &tunnelSession{
+		id:       id,
+		conn:     newTunnelConn(tunnelAddr(r.Host), tunnelAddr(r.RemoteAddr)),
+		interval: 1,
+	}
+	session.timer = time.AfterFunc(TunnelSessionTimeout, func() {
+		session.conn.Close()
+		self.removeSession(session)
+	})
+	session.conn.onclose = func() {
+		// what is left for the client goes with its next polls
+		if session.conn.drained() {
+			self.removeSession(session)
+		}
+	}
+
+	self.lock.Lock()
+	self.sessions[id] = session
+	self.lock.Unlock()
+
+	self.server.log(LevelDebug, "tunnel session opened", "id", id, "remote", r.RemoteAddr)
+
+	self.server.serveConn(self.server.newConn(session.conn))
+
+	self.writeResponse(w, []byte(id+"\n"))
+}
+
+func (self *TunnelHandler) removeSession(session *tunnelSession) {
+	session.timer.Stop()
+	self.lock.Lock()
+	delete(self.sessions, session.id)
+	self.lock.Unlock()
+}
+
+// writePending answers a send/idle with the polling interval and the data
+// queued for the client. The interval grows while there is nothing to send.
+// A closed session ends once the client took all of it.
+func (self *TunnelHandler) writePending(w http.ResponseWriter, session *tunnelSession) {
+	data := session.conn.pull()
+	if session.conn.drained() {
+		self.removeSession(session)
+	}
+	// requests of a session may overlap, interval is guarded by conn.lock
+	session.conn.lock.Lock()
+	if len(data) > 0 {
+		session.interval = 1
+	} else if session.interval < tunnelMaxInterval {
+		session.interval = session.interval*2 + 1
+		if session.interval > tunnelMaxInterval {
+			session.interval = tunnelMaxInterval
+		}
+	}
+	interval := session.interval
+	session.conn.lock.Unlock()
+	b := make([]byte, 1+len(data))
+	b[0] = interval
+	copy(b[1:], data)
+	self.writeResponse(w, b)
+}
+
+func (self *TunnelHandler) writeResponse(w http.ResponseWriter, b []byte) {
+	h := w.Header()
+	h.Set("Content-Type", tunnelContentType)
+	h.Set("Cache-Control", "no-cache")
+	w.Write(b)
+}
+
+// tunnelClient polls a RTMPT server and feeds a tunnelConn.
+type tunnelClient struct {
+	conn    *tunnelConn
+	baseurl string
+	id      string
+	client  *http.Client
+	// guarded by conn.lock, Close reads it from another goroutine
+	seq int
+	// the Logger of the Dialer
+	logger Logger
+}
+
+// tunnel poll interval unit, the server sends a multiplier in every response
+const tunnelIntervalUnit = time.Millisecond * 10
+
+func dialTunnel(ctx context.Context, host string, timeout time.Duration, logger Logger) (conn net.Conn, err error) {
+	self := &tunnelClient{
+		baseurl: "http://" + host,
+		client:  &http.Client{Timeout: timeout},
+		logger:  logger,
+	}
+
+	var body []byte
+	if body, err = self.postContext(ctx, "/open/1", []byte{0}); err != nil {
+		return
+	}
+	self.id = strings.TrimSpace(string(body))
+	if self.id == "" {
+		err = fmt.Errorf("rtmp: tunnel open: empty session id")
+		return
+	}
+
+	self.conn = newTunnelConn(tunnelAddr("rtmpt"), tunnelAddr(host))
+	self.conn.onclose = func() {
+		self.conn.lock.Lock()
+		seq := self.seq
+		self.conn.lock.Unlock()
+		self.post(fmt.Sprintf("/close/%s/%d", self.id, seq), []byte{0})
+	}
+	go self.poll()
+
+	conn = self.conn
+	return
+}
+
+func (self *tunnelClient) log(level Level, msg string, keyvals ...interface{}) {
+	logger := self.logger
+	if logger == nil {
+		if !Debug {
+			return
+		}
+		logger = debugLogger
+	}
+	logger.Log(level, msg, append([]interface{}{"remote", self.baseurl, "id", self.id}, keyvals...)...)
+}
+
+func (self *tunnelClient) post(path string, data []byte) (body []byte, err error) {
+	return self.postContext(context.Background(), path, data)
+}
+
+func (self *tunnelClient) postContext(ctx context.Context, path string, data []byte) (body []byte, err error) {
+	var req *http.Request
+	if req, err = http.NewRequest("POST", self.baseurl+path, bytes.NewReader(data)); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", tunnelContentType)
+
+	var resp *http.Response
+	if resp, err = self.client.Do(req.WithContext(ctx)); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err = fmt.Errorf("rtmp: tunnel %s: %s", path, resp.Status)
+		return
+	}
+	// the interval byte and at most tunnelMaxBuffered of data
+	body, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1+tunnelMaxBuffered))
+	return
+}
+
+// poll sends queued data with /send, or asks for server data with /idle
+// once the interval advised by the server has passed.
+func (self *tunnelClient) poll() {
+	interval := tunnelIntervalUnit
+	for {
+		conn := self.conn
+		conn.lock.Lock()
+		if conn.outbuf.Len() == 0 && !conn.closed {
+			expired := false
+			timer := time.AfterFunc(interval, func() {
+				conn.lock.Lock()
+				expired = true
+				conn.cond.Broadcast()
+				conn.lock.Unlock()
+			})
+			for conn.outbuf.Len() == 0 && !conn.closed && !expired {
+				conn.cond.Wait()
+			}
+			timer.Stop()
+		}
+		closed := conn.closed
+		if !closed {
+			self.seq++
+		}
+		seq := self.seq
+		conn.lock.Unlock()
+		if closed {
+			return
+		}
+
+		var path string
+		data := conn.pull()
+		if len(data) > 0 {
+			path = fmt.Sprintf("/send/%s/%d", self.id, seq)
+		} else {
+			path = fmt.Sprintf("/idle/%s/%d", self.id, seq)
+			data = []byte{0}
+		}
+
+		body, err := self.post(path, data)
+		if err != nil {
+			self.log(LevelDebug, "tunnel poll failed", "err", err)
+			// the server is gone, no /close for it
+			conn.lock.Lock()
+			conn.onclose = nil
+			conn.lock.Unlock()
+			conn.Close()
+			return
+		}
+		if len(body) > 0 {
+			interval = time.Duration(body[0]) * tunnelIntervalUnit
+			if len(body) > 1 {
+				if conn.push(body[1:]) != nil {
+					return
+				}
+				interval = tunnelIntervalUnit
+			}
+		}
+	}
+}
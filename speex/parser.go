@@ -0,0 +1,43 @@
+package speex
+
+import (
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// FLV only carries wideband speex, 16kHz mono.
+const (
+	SampleRate    = 16000
+	FrameDuration = 20 * time.Millisecond
+)
+
+type CodecData struct {
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.SPEEX
+}
+
+func (self CodecData) ChannelLayout() av.ChannelLayout {
+	return av.CH_MONO
+}
+
+func (self CodecData) SampleRate() int {
+	return SampleRate
+}
+
+func (self CodecData) SampleFormat() av.SampleFormat {
+	return av.S16
+}
+
+// PacketDuration assumes one frame per packet, as flash player sends it.
+// Frame boundaries are only known after decoding.
+func (self CodecData) PacketDuration(data []byte) (dur time.Duration, err error) {
+	dur = FrameDuration
+	return
+}
+
+func NewCodecData() CodecData {
+	return CodecData{}
+}
@@ -0,0 +1,123 @@
+package rtmp
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+)
+
+// Stats is a snapshot of a connection and of the streams read or written
+// on a Conn.
+type Stats struct {
+	// Age is the time since the connection was accepted or dialed.
+	Age time.Duration
+	// BytesIn and BytesOut count all of the connection, its other streams
+	// included.
+	BytesIn  uint64
+	BytesOut uint64
+	// Streams are indexed as Streams or WriteHeader.
+	Streams []StreamStats
+}
+
+// StreamStats is a snapshot of the packets of one stream.
+type StreamStats struct {
+	Type    av.CodecType
+	Packets uint64
+	Bytes   uint64
+	// Bitrate is over the last second, AvgBitrate since the first packet,
+	// both in bits per second.
+	Bitrate    float64
+	AvgBitrate float64
+	// FrameRate is the packets per second over the last second.
+	FrameRate float64
+	// KeyframeInterval is the packet time between the last two keyframes,
+	// video only.
+	KeyframeInterval time.Duration
+	// Drift is how far the packet times ran ahead of the wall clock since
+	// the first packet, negative when they fell behind.
+	Drift time.Duration
+}
+
+// statsWindow is the period of the current bitrate and frame rate.
+const statsWindow = time.Second
+
+type streamStats struct {
+	StreamStats
+	first     time.Time
+	firstTime time.Duration
+	// packets of the current window
+	winStart   time.Time
+	winBytes   uint64
+	winPackets uint64
+	keyTime    time.Duration
+	hasKey     bool
+}
+
+// Stats is safe to call from any goroutine.
+func (self *Conn) Stats() (stats Stats) {
+	stats.Age = time.Since(self.start)
+	stats.BytesIn = atomic.LoadUint64(&self.txrxcount.rxbytes)
+	stats.BytesOut = atomic.LoadUint64(&self.txrxcount.txbytes)
+
+	self.statslock.Lock()
+	defer self.statslock.Unlock()
+	now := time.Now()
+	for _, st := range self.stats {
+		s := st.StreamStats
+		if elapsed := now.Sub(st.first); !st.first.IsZero() && elapsed > 0 {
+			s.AvgBitrate = float64(s.Bytes*8) / elapsed.Seconds()
+		}
+		// a stream that stopped has no current rate
+		if now.Sub(st.winStart) > 2*statsWindow {
+			s.Bitrate = 0
+			s.FrameRate = 0
+		}
+		stats.Streams = append(stats.Streams, s)
+	}
+	return
+}
+
+func (self *Conn) countPacket(pkt av.Packet) {
+	self.statslock.Lock()
+	defer self.statslock.Unlock()
+
+	if self.stats == nil {
+		self.stats = make([]streamStats, len(self.streams))
+		for i, stream := range self.streams {
+			self.stats[i].Type = stream.Type()
+		}
+	}
+	if int(pkt.Idx) >= len(self.stats) {
+		return
+	}
+	st := &self.stats[pkt.Idx]
+
+	now := time.Now()
+	if st.first.IsZero() {
+		st.first = now
+		st.firstTime = pkt.Time
+		st.winStart = now
+	}
+	st.Packets++
+	st.Bytes += uint64(len(pkt.Data))
+	st.Drift = (pkt.Time - st.firstTime) - now.Sub(st.first)
+
+	if pkt.IsKeyFrame && st.Type.IsVideo() {
+		if st.hasKey {
+			st.KeyframeInterval = pkt.Time - st.keyTime
+		}
+		st.keyTime = pkt.Time
+		st.hasKey = true
+	}
+
+	st.winBytes += uint64(len(pkt.Data))
+	st.winPackets++
+	if elapsed := now.Sub(st.winStart); elapsed >= statsWindow {
+		st.Bitrate = float64(st.winBytes*8) / elapsed.Seconds()
+		st.FrameRate = float64(st.winPackets) / elapsed.Seconds()
+		st.winStart = now
+		st.winBytes = 0
+		st.winPackets = 0
+	}
+}
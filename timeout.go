@@ -0,0 +1,170 @@
+package rtmp
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Timeouts bound the phases of a connection, zero means no timeout.
+type Timeouts struct {
+	// Handshake bounds the rtmp handshake.
+	Handshake time.Duration
+	// Command bounds connect, createStream and publish or play.
+	Command time.Duration
+	// ReadIdle is how long the peer may send nothing once the streams
+	// are set up. Players send little besides Acks, Config.PingInterval
+	// should be below it for them.
+	ReadIdle time.Duration
+	// Write bounds every write to the peer.
+	Write time.Duration
+}
+
+// TimeoutError is returned when one of the Timeouts fires. After a read or
+// write timeout the connection is closed, as it may have stopped in the
+// middle of a chunk, and every stream on it fails with the error.
+type TimeoutError struct {
+	// Op is "handshake", "command", "read" or "write".
+	Op       string
+	Duration time.Duration
+}
+
+func (self *TimeoutError) Error() string {
+	return fmt.Sprintf("rtmp: %s timeout after %v", self.Op, self.Duration)
+}
+
+// Timeout makes TimeoutError a net.Error.
+func (self *TimeoutError) Timeout() bool {
+	return true
+}
+
+func (self *TimeoutError) Temporary() bool {
+	return false
+}
+
+// SetTimeouts sets the timeouts of the connection of self, the phases that
+// already began keep the ones they had. It may be called while the
+// connection is in use.
+func (self *Conn) SetTimeouts(timeouts Timeouts) {
+	self.tconn.lock.Lock()
+	self.tconn.timeouts = timeouts
+	self.tconn.lock.Unlock()
+}
+
+// Timeouts returns the timeouts set by SetTimeouts.
+func (self *Conn) Timeouts() Timeouts {
+	self.tconn.lock.Lock()
+	defer self.tconn.lock.Unlock()
+	return self.tconn.timeouts
+}
+
+// setPhaseDeadline sets the deadline of the handshake or command phase.
+func (self *Conn) setPhaseDeadline(timeout time.Duration) {
+	if timeout > 0 {
+		self.netconn.SetDeadline(time.Now().Add(timeout))
+	}
+}
+
+// endPhase clears the deadline of a phase that ended with err, and turns
+// the timeout of the phase into a TimeoutError.
+func (self *Conn) endPhase(err error, op string, timeout time.Duration) error {
+	if timeout <= 0 {
+		return err
+	}
+	if err != nil {
+		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+			err = &TimeoutError{Op: op, Duration: timeout}
+		}
+		return err
+	}
+	self.netconn.SetDeadline(time.Time{})
+	return nil
+}
+
+// timeoutConn sets the deadline of every read and write once the phases
+// are over, so that ReadIdle and Write count from the last progress. When
+// one fires the connection is closed, and what fails after returns the
+// TimeoutError.
+type timeoutConn struct {
+	net.Conn
+
+	lock     sync.Mutex
+	timeouts Timeouts
+	// set before the read loop starts
+	on  bool
+	err error
+}
+
+// timeout returns the ReadIdle or Write timeout once the phases are over,
+// zero before.
+func (self *timeoutConn) timeout(op string) time.Duration {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.on {
+		return 0
+	}
+	if op == "read" {
+		return self.timeouts.ReadIdle
+	}
+	return self.timeouts.Write
+}
+
+func (self *timeoutConn) start() {
+	self.lock.Lock()
+	self.on = true
+	self.lock.Unlock()
+}
+
+func (self *timeoutConn) Read(p []byte) (n int, err error) {
+	timeout := self.timeout("read")
+	if timeout > 0 {
+		self.Conn.SetReadDeadline(time.Now().Add(timeout))
+	}
+	if n, err = self.Conn.Read(p); err != nil {
+		err = self.fail(err, "read", timeout)
+	}
+	return
+}
+
+func (self *timeoutConn) Write(p []byte) (n int, err error) {
+	timeout := self.timeout("write")
+	if timeout > 0 {
+		self.Conn.SetWriteDeadline(time.Now().Add(timeout))
+	}
+	if n, err = self.Conn.Write(p); err != nil {
+		err = self.fail(err, "write", timeout)
+	}
+	return
+}
+
+func (self *timeoutConn) fail(err error, op string, timeout time.Duration) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.on {
+		return err
+	}
+	if self.err != nil {
+		return self.err
+	}
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() && timeout > 0 {
+		return self.expireLocked(op, timeout)
+	}
+	return err
+}
+
+// expire closes the connection with a TimeoutError.
+func (self *timeoutConn) expire(op string, timeout time.Duration) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.err != nil {
+		return self.err
+	}
+	return self.expireLocked(op, timeout)
+}
+
+func (self *timeoutConn) expireLocked(op string, timeout time.Duration) error {
+	self.err = &TimeoutError{Op: op, Duration: timeout}
+	self.Conn.Close()
+	return self.err
+}
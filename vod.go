@@ -0,0 +1,297 @@
+package rtmp
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/flv"
+)
+
+// Source is recorded content that can back a play session, a flv.Demuxer
+// on a file is one.
+type Source interface {
+	Streams() ([]av.CodecData, error)
+	ReadPacket() (av.Packet, error)
+	SeekToTime(time.Duration) error
+}
+
+// how far ahead of real time PlaySource sends
+const vodLead = time.Second
+
+type vodCommand struct {
+	name  string
+	pause bool
+	pos   time.Duration
+}
+
+// < pause(bool, ms), pauseRaw(bool, ms), seek(ms)
+//
+// They go to the PlaySource of the stream, streams without one use the
+// registered command handlers.
+func (self *Conn) handleVodCommand() (err error) {
+	var ctl chan vodCommand
+	self.lock.Lock()
+	if stream := self.msgstreams[self.msgsid]; stream != nil {
+		ctl = stream.vodctl
+	}
+	self.lock.Unlock()
+	if ctl == nil {
+		return self.dispatchCommand()
+	}
+
+	cmd := vodCommand{name: self.commandname}
+	var ms float64
+	switch self.commandname {
+	case "seek":
+		if len(self.commandparams) > 0 {
+			ms, _ = self.commandparams[0].(float64)
+		}
+	default:
+		if len(self.commandparams) > 0 {
+			cmd.pause, _ = self.commandparams[0].(bool)
+		}
+		if len(self.commandparams) > 1 {
+			ms, _ = self.commandparams[1].(float64)
+		}
+	}
+	cmd.pos = time.Duration(ms * float64(time.Millisecond))
+
+	if self.tracing() {
+		self.log(LevelTrace, "< "+cmd.name, "pause", cmd.pause, "pos", cmd.pos)
+	}
+
+	// drop it rather than stall the read loop when the source is stuck
+	select {
+	case ctl <- cmd:
+	default:
+	}
+	return
+}
+
+// writeStatus sends onStatus on the stream.
+func (self *Conn) writeStatus(level, code, description string) (err error) {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+
+	// > onStatus()
+	if err = self.writeCommandMsg(5, self.avmsgsid,
+		"onStatus", 0, nil,
+		flv.AMFMap{
+			"level":       level,
+			"code":        code,
+			"description": description,
+		},
+	); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+func (self *Conn) sendStreamEvent(eventtype uint16) (err error) {
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err = self.writeStreamEvent(eventtype, self.avmsgsid); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+// WriteStreamDry tells the player the stream has no data for now, for a
+// live source that stalled.
+func (self *Conn) WriteStreamDry() (err error) {
+	return self.sendStreamEvent(eventtypeStreamDry)
+}
+
+// PlaySource plays src on a server play stream, instead of WriteHeader and
+// WritePacket. It starts at PlayOptions.Start, sends in real time, and
+// follows pause and seek from the player. At the end of src it waits for a
+// seek, it returns when the player closes the stream or the connection.
+func (self *Conn) PlaySource(src Source) (err error) {
+	if !self.isserver || !self.playing {
+		err = fmt.Errorf("rtmp: PlaySource needs a server play stream")
+		return
+	}
+
+	var streams []av.CodecData
+	if streams, err = src.Streams(); err != nil {
+		return
+	}
+
+	opts := DefaultPlayOptions
+	if self.PlayOptions != nil {
+		opts = *self.PlayOptions
+	}
+	if opts.Start > 0 {
+		if err = src.SeekToTime(time.Duration(opts.Start * float64(time.Second))); err != nil {
+			return
+		}
+	}
+
+	ctl := make(chan vodCommand, 16)
+	self.lock.Lock()
+	self.vodctl = ctl
+	self.lock.Unlock()
+	defer func() {
+		self.lock.Lock()
+		self.vodctl = nil
+		self.lock.Unlock()
+	}()
+
+	if err = self.sendStreamEvent(eventtypeStreamIsRecorded); err != nil {
+		return
+	}
+	if err = self.WriteHeader(streams); err != nil {
+		return
+	}
+
+	_, name := SplitPath(self.URL)
+
+	var pkt av.Packet
+	var havepkt, paused, ended bool
+	rebase := true
+	var wallbase time.Time
+	var timebase time.Duration
+
+	handle := func(cmd vodCommand) (err error) {
+		switch cmd.name {
+		case "seek":
+			if err = src.SeekToTime(cmd.pos); err != nil {
+				return self.writeStatus("error", "NetStream.Seek.Failed", err.Error())
+			}
+			havepkt = false
+			ended = false
+			rebase = true
+			self.restartPlayDuration()
+			if err = self.sendStreamEvent(eventtypeStreamBegin); err != nil {
+				return
+			}
+			if err = self.writeStatus("status", "NetStream.Seek.Notify", "Seeking "+name); err != nil {
+				return
+			}
+			return self.writeStatus("status", "NetStream.Play.Start", "Playing "+name)
+
+		default:
+			if cmd.pause && !paused {
+				paused = true
+				return self.writeStatus("status", "NetStream.Pause.Notify", "Pausing "+name)
+			}
+			if !cmd.pause && paused {
+				paused = false
+				rebase = true
+				if err = self.sendStreamEvent(eventtypeStreamBegin); err != nil {
+					return
+				}
+				return self.writeStatus("status", "NetStream.Unpause.Notify", "Unpausing "+name)
+			}
+		}
+		return
+	}
+
+	for {
+		select {
+		case cmd := <-ctl:
+			if err = handle(cmd); err != nil {
+				return
+			}
+			continue
+		default:
+		}
+
+		var wait <-chan time.Time
+		if !paused && !ended {
+			if !havepkt {
+				if pkt, err = src.ReadPacket(); err == io.EOF {
+					ended = true
+					if err = self.sendStreamEvent(eventtypeStreamEOF); err != nil {
+						return
+					}
+					if err = self.writeStatus("status", "NetStream.Play.Stop", "Stopped playing "+name); err != nil {
+						return
+					}
+					continue
+				} else if err != nil {
+					return
+				}
+				havepkt = true
+			}
+			if rebase {
+				wallbase = time.Now()
+				timebase = pkt.Time
+				rebase = false
+			}
+
+			delay := wallbase.Add(pkt.Time - timebase - vodLead).Sub(time.Now())
+			if delay <= 0 {
+				if err = self.WritePacket(pkt); err != nil {
+					if err == io.EOF || self.isClosed() {
+						err = nil
+					}
+					return
+				}
+				havepkt = false
+				continue
+			}
+			wait = time.After(delay)
+		}
+
+		// nothing is due, send what is buffered before waiting
+		self.wlock.Lock()
+		err = self.flushWrite()
+		self.wlock.Unlock()
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-wait:
+		case cmd := <-ctl:
+			if err = handle(cmd); err != nil {
+				return
+			}
+		case <-self.done:
+			return
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+// Pause pauses or resumes a playing client stream, pos is the position the
+// player is at.
+func (self *Conn) Pause(pause bool, pos time.Duration) (err error) {
+	return self.sendVodCommand("pause", pause, float64(pos/time.Millisecond))
+}
+
+// Seek asks the server to play from pos.
+func (self *Conn) Seek(pos time.Duration) (err error) {
+	return self.sendVodCommand("seek", float64(pos/time.Millisecond))
+}
+
+func (self *Conn) sendVodCommand(name string, args ...interface{}) (err error) {
+	if self.isserver || !self.playing || self.stage < stageCommandDone {
+		err = fmt.Errorf("rtmp: %s needs a playing client", name)
+		return
+	}
+
+	// > pause(bool, ms), seek(ms)
+	if self.tracing() {
+		self.log(LevelTrace, "> "+name, "args", args)
+	}
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if err = self.writeCommandMsg(8, self.avmsgsid, append([]interface{}{name, 0, nil}, args...)...); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
@@ -0,0 +1,232 @@
+package vp9
+
+import (
+	"fmt"
+
+	"github.com/notedit/rtmp-lib/av"
+	"github.com/notedit/rtmp-lib/pio"
+)
+
+// VPCodecConfRecord is the vpcC box payload, carried in the enhanced rtmp
+// sequence start.
+type VPCodecConfRecord struct {
+	Profile                 uint8
+	Level                   uint8
+	BitDepth                uint8
+	ChromaSubsampling       uint8
+	VideoFullRangeFlag      uint8
+	ColourPrimaries         uint8
+	TransferCharacteristics uint8
+	MatrixCoefficients      uint8
+	CodecInitData           []byte
+}
+
+var ErrDecconfInvalid = fmt.Errorf("vp9parser: VPCodecConfRecord invalid")
+
+func (self *VPCodecConfRecord) Unmarshal(b []byte) (n int, err error) {
+	// some muxers keep the FullBox version and flags
+	if len(b) >= 12 && b[0] == 1 && b[1] == 0 && b[2] == 0 && b[3] == 0 {
+		n += 4
+	}
+	if len(b) < n+8 {
+		err = ErrDecconfInvalid
+		return
+	}
+	self.Profile = b[n]
+	self.Level = b[n+1]
+	self.BitDepth = b[n+2] >> 4
+	self.ChromaSubsampling = (b[n+2] >> 1) & 0x7
+	self.VideoFullRangeFlag = b[n+2] & 0x1
+	self.ColourPrimaries = b[n+3]
+	self.TransferCharacteristics = b[n+4]
+	self.MatrixCoefficients = b[n+5]
+	initlen := int(pio.U16BE(b[n+6:]))
+	n += 8
+	if len(b) < n+initlen {
+		err = ErrDecconfInvalid
+		return
+	}
+	self.CodecInitData = b[n : n+initlen]
+	n += initlen
+	return
+}
+
+func (self VPCodecConfRecord) Len() int {
+	return 8 + len(self.CodecInitData)
+}
+
+func (self VPCodecConfRecord) Marshal(b []byte) (n int) {
+	b[0] = self.Profile
+	b[1] = self.Level
+	b[2] = self.BitDepth<<4 | (self.ChromaSubsampling&0x7)<<1 | self.VideoFullRangeFlag&0x1
+	b[3] = self.ColourPrimaries
+	b[4] = self.TransferCharacteristics
+	b[5] = self.MatrixCoefficients
+	pio.PutU16BE(b[6:], uint16(len(self.CodecInitData)))
+	n += 8
+	copy(b[n:], self.CodecInitData)
+	n += len(self.CodecInitData)
+	return
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (self *bitReader) ReadBits(n int) (val uint, err error) {
+	for i := 0; i < n; i++ {
+		if self.pos>>3 >= len(self.b) {
+			err = fmt.Errorf("vp9parser: frame header too short")
+			return
+		}
+		bit := (self.b[self.pos>>3] >> uint(7-self.pos&7)) & 1
+		val = val<<1 | uint(bit)
+		self.pos++
+	}
+	return
+}
+
+// ParseKeyFrameSize returns the frame size coded in an uncompressed keyframe
+// header. ok is false for inter frames.
+func ParseKeyFrameSize(frame []byte) (width, height int, ok bool, err error) {
+	r := &bitReader{b: frame}
+	var v uint
+
+	// frame_marker
+	if v, err = r.ReadBits(2); err != nil {
+		return
+	}
+	if v != 2 {
+		err = fmt.Errorf("vp9parser: frame marker invalid")
+		return
+	}
+	var lo, hi uint
+	if lo, err = r.ReadBits(1); err != nil {
+		return
+	}
+	if hi, err = r.ReadBits(1); err != nil {
+		return
+	}
+	profile := hi<<1 | lo
+	if profile == 3 {
+		// reserved_zero
+		if _, err = r.ReadBits(1); err != nil {
+			return
+		}
+	}
+	// show_existing_frame
+	if v, err = r.ReadBits(1); err != nil {
+		return
+	}
+	if v != 0 {
+		return
+	}
+	// frame_type
+	if v, err = r.ReadBits(1); err != nil {
+		return
+	}
+	if v != 0 {
+		return
+	}
+	// show_frame, error_resilient_mode
+	if _, err = r.ReadBits(2); err != nil {
+		return
+	}
+	// frame_sync_code
+	if v, err = r.ReadBits(24); err != nil {
+		return
+	}
+	if v != 0x498342 {
+		err = fmt.Errorf("vp9parser: frame sync code invalid")
+		return
+	}
+
+	// color_config
+	if profile >= 2 {
+		// ten_or_twelve_bit
+		if _, err = r.ReadBits(1); err != nil {
+			return
+		}
+	}
+	var colorSpace uint
+	if colorSpace, err = r.ReadBits(3); err != nil {
+		return
+	}
+	if colorSpace != 7 {
+		// color_range
+		if _, err = r.ReadBits(1); err != nil {
+			return
+		}
+		if profile == 1 || profile == 3 {
+			// subsampling_x, subsampling_y, reserved_zero
+			if _, err = r.ReadBits(3); err != nil {
+				return
+			}
+		}
+	} else if profile == 1 || profile == 3 {
+		// reserved_zero
+		if _, err = r.ReadBits(1); err != nil {
+			return
+		}
+	}
+
+	// frame_size
+	if v, err = r.ReadBits(16); err != nil {
+		return
+	}
+	width = int(v) + 1
+	if v, err = r.ReadBits(16); err != nil {
+		return
+	}
+	height = int(v) + 1
+	ok = true
+	return
+}
+
+func IsKeyFrame(frame []byte) bool {
+	_, _, ok, _ := ParseKeyFrameSize(frame)
+	return ok
+}
+
+type CodecData struct {
+	Record     []byte
+	RecordInfo VPCodecConfRecord
+	width      int
+	height     int
+}
+
+func (self CodecData) Type() av.CodecType {
+	return av.VP9
+}
+
+func (self CodecData) VPCodecConfRecordBytes() []byte {
+	return self.Record
+}
+
+// Width is 0 until a keyframe was seen, vpcC does not carry the frame size.
+func (self CodecData) Width() int {
+	return self.width
+}
+
+func (self CodecData) Height() int {
+	return self.height
+}
+
+// WithKeyFrame returns a copy of the codec data with the size taken from a
+// keyframe.
+func (self CodecData) WithKeyFrame(frame []byte) CodecData {
+	if width, height, ok, _ := ParseKeyFrameSize(frame); ok {
+		self.width = width
+		self.height = height
+	}
+	return self
+}
+
+func NewCodecDataFromVPCodecConfRecord(record []byte) (self CodecData, err error) {
+	self.Record = record
+	if _, err = (&self.RecordInfo).Unmarshal(record); err != nil {
+		return
+	}
+	return
+}
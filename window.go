@@ -0,0 +1,164 @@
+package rtmp
+
+import (
+	"time"
+)
+
+// limit types of SetPeerBandwidth
+const (
+	peerBandwidthHard    = 0
+	peerBandwidthSoft    = 1
+	peerBandwidthDynamic = 2
+)
+
+// peerAckTimeout is how long a full window waits for the first Ack of the
+// peer. A peer that sets a bandwidth limit but sends no Acks has its limit
+// ignored after it, until an Ack comes.
+const peerAckTimeout = 10 * time.Second
+
+// AckProgress is the flow control state of a connection.
+type AckProgress struct {
+	// Sent counts the chunk bytes written, Acked is the sequence number
+	// of the last Ack from the peer, both wrap at 4GB.
+	Sent  uint32
+	Acked uint32
+	// AckTime is when the last Ack came, zero if none did.
+	AckTime time.Time
+	// Window is the limit of unacknowledged bytes set by the peer with
+	// SetPeerBandwidth, 0 for none.
+	Window uint32
+}
+
+// AckProgress reports how far the peer acknowledged what was written.
+func (self *Conn) AckProgress() (progress AckProgress) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	progress.Sent = self.writeBytes
+	progress.Acked = self.peerAcked
+	progress.AckTime = self.peerAckTime
+	progress.Window = self.peerBandwidth
+	return
+}
+
+func (self *Conn) handleAck(seqnum uint32) {
+	// < Ack
+	if self.tracing() {
+		self.log(LevelTrace, "< Ack", "seqnum", seqnum)
+	}
+	self.lock.Lock()
+	self.peerAcked = seqnum
+	self.peerAckTime = time.Now()
+	self.peerNoAcks = false
+	close(self.ackwait)
+	self.ackwait = make(chan struct{})
+	self.lock.Unlock()
+}
+
+// setPeerBandwidth applies the limit of SetPeerBandwidth, and asks the peer
+// to send Acks at that window. The limit starts hard and unlimited, so a
+// dynamic one applies until a soft one came.
+func (self *Conn) setPeerBandwidth(size uint32, limittype uint8) (err error) {
+	// < SetPeerBandwidth
+	if self.tracing() {
+		self.log(LevelTrace, "< SetPeerBandwidth", "size", size, "limittype", limittype)
+	}
+
+	self.lock.Lock()
+	switch limittype {
+	case peerBandwidthHard:
+	case peerBandwidthSoft:
+		if self.peerBandwidth != 0 && self.peerBandwidth < size {
+			size = self.peerBandwidth
+		}
+	case peerBandwidthDynamic:
+		if self.peerLimitType != peerBandwidthHard {
+			self.lock.Unlock()
+			return
+		}
+		limittype = peerBandwidthHard
+	default:
+		self.lock.Unlock()
+		err = protocolError("SetPeerBandwidth limit type=%d invalid", limittype)
+		return
+	}
+	self.peerBandwidth = size
+	self.peerLimitType = limittype
+	close(self.ackwait)
+	self.ackwait = make(chan struct{})
+	self.lock.Unlock()
+
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if size == self.writeAckSize {
+		return
+	}
+	// > WindowAckSize
+	if err = self.writeWindowAckSize(size); err != nil {
+		return
+	}
+	if err = self.flushWrite(); err != nil {
+		return
+	}
+	return
+}
+
+// waitWindow waits until the unacknowledged bytes are within the peer's
+// limit. What is buffered is flushed first, the peer can't ack it
+// otherwise.
+func (self *Conn) waitWindow() (err error) {
+	for {
+		self.lock.Lock()
+		window := self.peerBandwidth
+		// an Ack ahead of what was written, for a peer that counts the
+		// handshake too, leaves nothing in flight
+		inflight := int32(self.writeBytes - self.peerAcked)
+		full := window != 0 && !self.peerNoAcks && inflight > 0 && uint32(inflight) > window
+		noacks := self.peerAckTime.IsZero()
+		ackwait := self.ackwait
+		self.lock.Unlock()
+		if !full {
+			return
+		}
+
+		self.wlock.Lock()
+		err = self.flushWrite()
+		self.wlock.Unlock()
+		if err != nil {
+			return
+		}
+		if self.windowFullError {
+			err = ErrWindowFull
+			return
+		}
+
+		self.log(LevelDebug, "window full, waiting for Ack", "window", window)
+		// the wait is part of the write bounded by the write timeout
+		var expired, fallback <-chan time.Time
+		timeout := self.Timeouts().Write
+		if timeout > 0 {
+			expired = time.After(timeout)
+		}
+		if noacks {
+			fallback = time.After(peerAckTimeout)
+		}
+		select {
+		case <-expired:
+			err = self.tconn.expire("write", timeout)
+			return
+		case <-fallback:
+			self.lock.Lock()
+			if self.peerAckTime.IsZero() {
+				self.peerNoAcks = true
+			}
+			self.lock.Unlock()
+			self.log(LevelWarn, "peer sends no Acks, ignoring its bandwidth limit", "window", window)
+		case <-ackwait:
+		case <-self.done:
+			err = self.closedError()
+			return
+		case <-self.closed:
+			err = self.readerr
+			return
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package rtmp
+
+import (
+	"net"
+	"testing"
+)
+
+func TestWaitWindow(t *testing.T) {
+	cliconn, srvconn := net.Pipe()
+	defer cliconn.Close()
+	defer srvconn.Close()
+	conn := NewConn(cliconn, 4096)
+	conn.windowFullError = true
+	conn.peerBandwidth = 100
+
+	vectors := []struct {
+		name        string
+		sent, acked uint32
+		full        bool
+	}{
+		{"within", 150, 100, false},
+		{"full", 250, 100, true},
+		{"ack ahead", 50, 1000, false},
+		{"wrapped", 10, 0xfffffff0, false},
+		{"wrapped full", 200, 0xfffffff0, true},
+	}
+	for _, v := range vectors {
+		conn.writeBytes = v.sent
+		conn.peerAcked = v.acked
+		err := conn.waitWindow()
+		if v.full && err != ErrWindowFull || !v.full && err != nil {
+			t.Errorf("%s: got %v", v.name, err)
+		}
+	}
+}